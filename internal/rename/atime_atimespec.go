@@ -0,0 +1,20 @@
+//go:build darwin || freebsd
+
+package rename
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the last access time of a file
+func accessTime(info os.FileInfo) time.Time {
+	st := info.Sys().(*syscall.Stat_t)
+	return time.Unix(st.Atimespec.Unix())
+}
+
+// modTime returns the modification time in a raw stat
+func modTime(st *syscall.Stat_t) time.Time {
+	return time.Unix(st.Mtimespec.Unix())
+}
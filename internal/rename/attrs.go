@@ -0,0 +1,288 @@
+package rename
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// AttrTimeLayout is how modification times are shown in the editor buffer
+const AttrTimeLayout = "2006-01-02T15:04"
+
+// Attrs are the attributes of a file that --attrs edits
+type Attrs struct {
+	Mode  uint32 // permission bits, with setuid, setgid and sticky
+	User  string // user name, or numeric id if it has none
+	Group string // group name, or numeric id if it has none
+	Mtime time.Time
+}
+
+// String formats attrs for the log, with the full modification time
+func (a Attrs) String() string {
+	return fmt.Sprintf("%04o %s:%s %s", a.Mode, a.User, a.Group, a.Mtime.Format(time.RFC3339Nano))
+}
+
+// parseAttrs reads attributes formatted by String
+func parseAttrs(s string) (Attrs, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return Attrs{}, fmt.Errorf("malformed attributes: %s", s)
+	}
+	mode, err := parseMode(fields[0])
+	if err != nil {
+		return Attrs{}, err
+	}
+	owner, group, ok := strings.Cut(fields[1], ":")
+	if !ok {
+		return Attrs{}, fmt.Errorf("malformed owner: %s", fields[1])
+	}
+	mtime, err := time.Parse(time.RFC3339Nano, fields[2])
+	if err != nil {
+		return Attrs{}, fmt.Errorf("malformed time: %s", fields[2])
+	}
+	return Attrs{Mode: mode, User: owner, Group: group, Mtime: mtime}, nil
+}
+
+func parseMode(s string) (uint32, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid mode %s, expected octal such as 0644", s)
+	}
+	return uint32(mode), nil
+}
+
+// readAttrs returns the attributes of path itself, not following a symlink
+func readAttrs(path string) (Attrs, os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return Attrs{}, nil, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return Attrs{}, nil, fmt.Errorf("cannot read the owner of %s", path)
+	}
+
+	attrs := Attrs{
+		Mode:  uint32(st.Mode) & 07777,
+		User:  strconv.FormatUint(uint64(st.Uid), 10),
+		Group: strconv.FormatUint(uint64(st.Gid), 10),
+		Mtime: info.ModTime(),
+	}
+	if u, err := user.LookupId(attrs.User); err == nil {
+		attrs.User = u.Username
+	}
+	if g, err := user.LookupGroupId(attrs.Group); err == nil {
+		attrs.Group = g.Name
+	}
+	return attrs, info, nil
+}
+
+// ReadAttrs returns the attributes of each of files
+func ReadAttrs(files []string) ([]Attrs, error) {
+	attrs := make([]Attrs, len(files))
+	for i, file := range files {
+		var err error
+		if attrs[i], _, err = readAttrs(file); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+// AttrLines returns the editor lines for editing attributes: mode,
+// user:group and modification time columns, then the name
+func AttrLines(files []string, attrs []Attrs) []string {
+	width := 0
+	for _, a := range attrs {
+		width = max(width, len(a.User)+1+len(a.Group))
+	}
+
+	lines := make([]string, len(files))
+	for i, file := range files {
+		a := attrs[i]
+		lines[i] = fmt.Sprintf("%04o %-*s %s %s", a.Mode, width, a.User+":"+a.Group,
+			a.Mtime.Local().Format(AttrTimeLayout), file)
+	}
+	return lines
+}
+
+// ParseAttrLines parses edited attribute lines into names and attributes.
+// A time column left as it was keeps the exact modification time in old.
+func ParseAttrLines(lines []string, old []Attrs) (names []string, attrs []Attrs, err error) {
+	if len(lines) != len(old) {
+		return nil, nil, fmt.Errorf("line count mismatch: expected %d lines, got %d lines", len(old), len(lines))
+	}
+
+	for i, line := range lines {
+		name, a, err := parseAttrLine(line, old[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		names = append(names, name)
+		attrs = append(attrs, a)
+	}
+	return names, attrs, nil
+}
+
+func parseAttrLine(line string, old Attrs) (string, Attrs, error) {
+	var fields [3]string
+	rest := line
+	for j := range fields {
+		rest = strings.TrimLeft(rest, " \t")
+		fields[j], rest, _ = strings.Cut(rest, " ")
+	}
+	name := strings.TrimSpace(rest)
+	if name == "" {
+		return "", Attrs{}, fmt.Errorf("not of the form \"mode user:group time name\": %s", line)
+	}
+
+	a := old
+	var err error
+	if a.Mode, err = parseMode(fields[0]); err != nil {
+		return "", Attrs{}, err
+	}
+	var ok bool
+	if a.User, a.Group, ok = strings.Cut(fields[1], ":"); !ok {
+		return "", Attrs{}, fmt.Errorf("expected user:group, got %s", fields[1])
+	}
+	if _, err := lookupUser(a.User); err != nil {
+		return "", Attrs{}, err
+	}
+	if _, err := lookupGroup(a.Group); err != nil {
+		return "", Attrs{}, err
+	}
+	if fields[2] != old.Mtime.Local().Format(AttrTimeLayout) {
+		if a.Mtime, err = parseTime(fields[2]); err != nil {
+			return "", Attrs{}, err
+		}
+	}
+	return name, a, nil
+}
+
+// AttrConflicts is Conflicts for the attribute lines of --attrs: the
+// columns are parsed, and only the names are checked as paths
+func AttrConflicts(files []string, old []Attrs, lines []string) []LineConflict {
+	return lineConflicts(files, lines, func(i int, line string) (string, error) {
+		name, _, err := parseAttrLine(line, old[i])
+		return name, err
+	})
+}
+
+// parseTime reads a local time with minutes, or with seconds
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{AttrTimeLayout, AttrTimeLayout + ":05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, expected %s", s, AttrTimeLayout)
+}
+
+func lookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown user %s", name)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %s", name)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// AttrsPlan returns the operations that give each of files whose
+// attributes were edited its new attributes. They use the files' current
+// paths and must run before the renames. Symlinks only have an owner to
+// change.
+func AttrsPlan(files []string, old, edited []Attrs) ([]RenameOp, error) {
+	var plan []RenameOp
+	for i, file := range files {
+		if edited[i] == old[i] {
+			continue
+		}
+		info, err := os.Lstat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 && (edited[i].Mode != old[i].Mode || !edited[i].Mtime.Equal(old[i].Mtime)) {
+			return nil, fmt.Errorf("%s is a symlink, only its owner can be changed", file)
+		}
+		plan = append(plan, RenameOp{From: file, To: file, Kind: OpAttrs, OldAttrs: old[i], Attrs: edited[i]})
+	}
+	return plan, nil
+}
+
+// changeAttrs gives path the fields of attrs that differ from old, provided
+// each still has its old value. The owner goes first, as chown may clear
+// the setuid and setgid bits. If a step fails, the earlier ones are undone.
+func changeAttrs(path string, old, attrs Attrs) error {
+	current, info, err := readAttrs(path)
+	if err != nil {
+		return err
+	}
+
+	var undo []func()
+	fail := func(err error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return err
+	}
+
+	if attrs.User != old.User || attrs.Group != old.Group {
+		if current.User != old.User || current.Group != old.Group {
+			return fail(fmt.Errorf("owner is now %s:%s", current.User, current.Group))
+		}
+		uid, err := lookupUser(attrs.User)
+		if err != nil {
+			return fail(err)
+		}
+		gid, err := lookupGroup(attrs.Group)
+		if err != nil {
+			return fail(err)
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fail(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		undo = append(undo, func() {
+			os.Lchown(path, int(st.Uid), int(st.Gid))
+			syscall.Chmod(path, current.Mode)
+		})
+	}
+
+	if attrs.Mode != old.Mode {
+		if current.Mode != old.Mode {
+			return fail(fmt.Errorf("mode is now %04o", current.Mode))
+		}
+		if err := syscall.Chmod(path, attrs.Mode); err != nil {
+			return fail(err)
+		}
+		undo = append(undo, func() { syscall.Chmod(path, current.Mode) })
+	}
+
+	if !attrs.Mtime.Equal(old.Mtime) {
+		if !current.Mtime.Equal(old.Mtime) {
+			return fail(fmt.Errorf("modification time is now %s", current.Mtime.Format(time.RFC3339)))
+		}
+		if err := os.Chtimes(path, accessTime(info), attrs.Mtime); err != nil {
+			return fail(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package rename
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BackupPolicy selects how overwritten files are kept, as in GNU mv
+type BackupPolicy int
+
+const (
+	BackupNone     BackupPolicy = iota // overwritten files are replaced
+	BackupSimple                       // name~
+	BackupNumbered                     // name.~N~
+	BackupExisting                     // numbered if numbered backups exist, simple otherwise
+)
+
+// ParseBackupPolicy parses a --backup argument, accepting the GNU names
+func ParseBackupPolicy(s string) (BackupPolicy, error) {
+	switch s {
+	case "none", "off":
+		return BackupNone, nil
+	case "simple", "never":
+		return BackupSimple, nil
+	case "numbered", "t":
+		return BackupNumbered, nil
+	case "existing", "nil", "":
+		return BackupExisting, nil
+	}
+	return BackupNone, fmt.Errorf("invalid backup policy %q: use simple, numbered or existing", s)
+}
+
+// AddBackups inserts, before each operation that overwrites one of
+// overwrites, a hop that first moves the existing target to a backup name.
+// Backup names are checked like any other target: a backup that would
+// replace an existing file is an error, never a silent overwrite.
+func AddBackups(plan []RenameOp, overwrites []string, policy BackupPolicy) ([]RenameOp, error) {
+	targets := make(map[string]bool)
+	for _, file := range overwrites {
+		targets[file] = true
+	}
+
+	taken := make(map[string]bool)
+	for _, op := range plan {
+		taken[op.From] = true
+		taken[op.To] = true
+	}
+
+	group := nextGroup(plan)
+	var result []RenameOp
+	for _, op := range plan {
+		if op.Kind == OpRename && targets[op.To] {
+			backup, err := backupName(op.To, policy, taken)
+			if err != nil {
+				return nil, err
+			}
+			taken[backup] = true
+			result = append(result, RenameOp{From: op.To, To: backup, Kind: OpBackup, Group: group})
+			op.Overwrite = false
+			op.Group = group
+			group++
+		}
+		result = append(result, op)
+	}
+
+	return result, nil
+}
+
+// backupName picks the backup name for path under policy
+func backupName(path string, policy BackupPolicy, taken map[string]bool) (string, error) {
+	highest := highestBackup(path)
+	if policy == BackupExisting {
+		policy = BackupSimple
+		if highest > 0 {
+			policy = BackupNumbered
+		}
+	}
+
+	if policy == BackupNumbered {
+		for n := highest + 1; ; n++ {
+			name := fmt.Sprintf("%s.~%d~", path, n)
+			if _, err := os.Lstat(name); os.IsNotExist(err) && !taken[name] {
+				return name, nil
+			}
+		}
+	}
+
+	name := path + "~"
+	if _, err := os.Lstat(name); err == nil || taken[name] {
+		return "", fmt.Errorf("backup %s already exists: remove it or use --backup=numbered", name)
+	}
+	return name, nil
+}
+
+// highestBackup returns the largest N of the existing path.~N~ backups
+func highestBackup(path string) int {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return 0
+	}
+
+	prefix := filepath.Base(path) + ".~"
+	highest := 0
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || !strings.HasSuffix(rest, "~") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(rest, "~")); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
@@ -0,0 +1,9 @@
+package rename
+
+// BusyFile is a file that a running process holds open, or a directory
+// that is a process's working directory or contains a file it holds open
+type BusyFile struct {
+	Path    string
+	PID     int
+	Command string
+}
@@ -0,0 +1,77 @@
+package rename
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FindBusy scans the open files and working directories of all processes
+// in /proc and returns those that refer to one of paths, or for a
+// directory to anything underneath it. Processes whose details cannot be
+// read, such as those of other users, are skipped.
+func FindBusy(paths []string) []BusyFile {
+	// Resolve only the parent, so a symlink is not confused with its target
+	sources := make(map[string]string)
+	for _, path := range paths {
+		dir, err := filepath.Abs(parentDir(path))
+		if err != nil {
+			continue
+		}
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		sources[filepath.Join(dir, filepath.Base(filepath.Clean(path)))] = path
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	self := os.Getpid()
+	var busy []BusyFile
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		proc := filepath.Join("/proc", entry.Name())
+
+		links := []string{filepath.Join(proc, "cwd")}
+		if fds, err := os.ReadDir(filepath.Join(proc, "fd")); err == nil {
+			for _, fd := range fds {
+				links = append(links, filepath.Join(proc, "fd", fd.Name()))
+			}
+		}
+
+		found := make(map[string]bool)
+		for _, link := range links {
+			target, err := os.Readlink(link)
+			if err != nil || !strings.HasPrefix(target, "/") || strings.HasSuffix(target, " (deleted)") {
+				continue
+			}
+			for p := target; ; p = filepath.Dir(p) {
+				if path, ok := sources[p]; ok && !found[path] {
+					found[path] = true
+					busy = append(busy, BusyFile{Path: path, PID: pid, Command: command(proc)})
+				}
+				if p == "/" {
+					break
+				}
+			}
+		}
+	}
+
+	return busy
+}
+
+// command returns the name of the process at proc
+func command(proc string) string {
+	comm, err := os.ReadFile(filepath.Join(proc, "comm"))
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(comm))
+}
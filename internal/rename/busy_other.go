@@ -0,0 +1,8 @@
+//go:build !linux
+
+package rename
+
+// FindBusy needs /proc and finds nothing on other systems
+func FindBusy(paths []string) []BusyFile {
+	return nil
+}
@@ -0,0 +1,96 @@
+package rename
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// foldingDirs records, per directory, whether it was found to be case
+// insensitive (vfat, exfat, CIFS, ext4 with casefold, macOS by default).
+// Directories that could not be probed are missing and count as case
+// sensitive.
+var foldingDirs sync.Map // dir -> bool
+
+// detectCaseFolding probes the directory of each path that has not been
+// probed yet, using the first of its files whose name has a cased letter
+func detectCaseFolding(paths []string) {
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if _, ok := foldingDirs.Load(dir); ok {
+			continue
+		}
+		if folding, ok := probeCaseFolding(path); ok {
+			foldingDirs.Store(dir, folding)
+		}
+	}
+}
+
+// probeCaseFolding looks path up with the case of its name swapped. The
+// directory folds case if that finds the same file without a directory
+// entry of that name, which would be a hard link instead.
+func probeCaseFolding(path string) (folding, ok bool) {
+	name := filepath.Base(path)
+	swapped := strings.Map(swapCase, name)
+	if swapped == name {
+		return false, false
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, false
+	}
+	other, err := os.Lstat(filepath.Join(filepath.Dir(path), swapped))
+	if err != nil {
+		return false, true
+	}
+	if !os.SameFile(info, other) {
+		return false, true
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return false, false
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return false, false
+	}
+	for _, entry := range names {
+		if entry == swapped {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+func swapCase(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
+
+// foldPath returns the key under which path is compared with other paths:
+// path itself, or in a case-insensitive directory the path with its name
+// in lower case
+func foldPath(path string) string {
+	if folding, _ := foldingDirs.Load(filepath.Dir(path)); folding == true {
+		return filepath.Join(filepath.Dir(path), strings.ToLower(filepath.Base(path)))
+	}
+	return path
+}
+
+// caseHop renames from to a name differing only in case through a temp
+// file, since a case-insensitive filesystem sees the target as taken
+func caseHop(from, to string, group int, taken map[string]bool) []RenameOp {
+	temp := tempName(filepath.Dir(from), taken)
+	taken[temp] = true
+	return []RenameOp{
+		{From: from, To: temp, Group: group},
+		{From: temp, To: to, Group: group},
+	}
+}
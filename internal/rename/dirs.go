@@ -0,0 +1,112 @@
+package rename
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// dirIdentity records which directory a path referred to at validation time
+type dirIdentity struct {
+	real string // absolute path with symlinks resolved
+	dev  uint64
+	ino  uint64
+}
+
+// DirSnapshot holds the identity of every parent directory in a rename, so
+// the executor can refuse to run if one has been swapped since validation
+type DirSnapshot map[string]dirIdentity
+
+// SnapshotDirs records the parent directories of files
+func SnapshotDirs(files []string) (DirSnapshot, error) {
+	snapshot := make(DirSnapshot)
+	for _, file := range files {
+		if _, err := snapshot.identify(parentDir(file)); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// identify returns the recorded identity of dir, recording it first if the
+// snapshot has not seen it
+func (s DirSnapshot) identify(dir string) (dirIdentity, error) {
+	if id, ok := s[dir]; ok {
+		return id, nil
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dirIdentity{}, fmt.Errorf("failed to resolve directory %s: %w", dir, err)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if errors.Is(err, syscall.ENAMETOOLONG) {
+		// Too deep to resolve by path; it is opened component by component
+		real, err = abs, nil
+	}
+	if err != nil {
+		return dirIdentity{}, fmt.Errorf("failed to resolve directory %s: %w", dir, err)
+	}
+
+	st, err := statDir(real)
+	if err != nil {
+		return dirIdentity{}, fmt.Errorf("failed to stat directory %s: %w", dir, err)
+	}
+
+	id := dirIdentity{real: real, dev: uint64(st.Dev), ino: uint64(st.Ino)}
+	s[dir] = id
+	return id, nil
+}
+
+// parentDir returns the directory containing path, ignoring trailing slashes
+func parentDir(path string) string {
+	return filepath.Dir(filepath.Clean(path))
+}
+
+// dirSet holds the open parent directories of a plan
+type dirSet map[string]*dirHandle
+
+// openDirs opens every directory the plan touches and checks that each is
+// still the directory recorded in snapshot. Nothing is renamed if any check
+// fails.
+func openDirs(plan []RenameOp, snapshot DirSnapshot) (dirSet, error) {
+	if snapshot == nil {
+		snapshot = make(DirSnapshot)
+	}
+
+	dirs := make(dirSet)
+	for _, op := range plan {
+		for _, path := range []string{op.From, op.To} {
+			dir := parentDir(path)
+			if dirs[dir] != nil {
+				continue
+			}
+
+			id, err := snapshot.identify(dir)
+			if err != nil {
+				dirs.close()
+				return nil, err
+			}
+			handle, err := openDirHandle(id)
+			if err != nil {
+				dirs.close()
+				return nil, err
+			}
+			dirs[dir] = handle
+		}
+	}
+
+	return dirs, nil
+}
+
+// locate returns the open directory holding path and the name within it
+func (d dirSet) locate(path string) (*dirHandle, string) {
+	return d[parentDir(path)], filepath.Base(filepath.Clean(path))
+}
+
+func (d dirSet) close() {
+	for _, handle := range d {
+		handle.close()
+	}
+}
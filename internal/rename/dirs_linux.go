@@ -0,0 +1,115 @@
+package rename
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// dirHandle is an open directory that renames are resolved against, so a
+// path component swapped for a symlink cannot redirect them
+type dirHandle struct {
+	fd   int
+	path string
+}
+
+const dirOpenFlags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+
+// openDirHandle opens the directory recorded in id and verifies that it is
+// still the same inode
+func openDirHandle(id dirIdentity) (*dirHandle, error) {
+	fd, err := openDir(id.real)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open directory %s: %w", id.real, err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to stat directory %s: %w", id.real, err)
+	}
+	if uint64(st.Dev) != id.dev || uint64(st.Ino) != id.ino {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("directory %s was replaced after validation", id.real)
+	}
+
+	return &dirHandle{fd: fd, path: id.real}, nil
+}
+
+// openDir opens a directory without following a final symlink
+func openDir(path string) (int, error) {
+	fd, err := syscall.Open(path, dirOpenFlags, 0)
+	if err == syscall.ENAMETOOLONG {
+		fd, err = openDirWalk(path)
+	}
+	return fd, err
+}
+
+// openDirWalk opens an absolute path one component at a time, for paths
+// longer than PATH_MAX
+func openDirWalk(path string) (int, error) {
+	fd, err := syscall.Open("/", dirOpenFlags, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		next, err := syscall.Openat(fd, name, dirOpenFlags, 0)
+		syscall.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+
+	return fd, nil
+}
+
+// statDir stats a directory, walking paths longer than PATH_MAX
+func statDir(path string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	err := syscall.Stat(path, &st)
+	if err != syscall.ENAMETOOLONG {
+		return &st, err
+	}
+
+	fd, err := openDirWalk(path)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	return &st, syscall.Fstat(fd, &st)
+}
+
+// lstatPath stats path without following a final symlink, walking paths
+// longer than PATH_MAX
+func lstatPath(path string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	if err != syscall.ENAMETOOLONG {
+		return &st, err
+	}
+
+	fd, err := openDirWalk(parentDir(path))
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	return lstatAt(&dirHandle{fd: fd, path: parentDir(path)}, filepath.Base(filepath.Clean(path)))
+}
+
+func (h *dirHandle) close() {
+	syscall.Close(h.fd)
+}
+
+// renameAt renames a name in one open directory to a name in another
+func renameAt(from *dirHandle, fromName string, to *dirHandle, toName string, flags uintptr) error {
+	if flags == 0 {
+		return syscall.Renameat(from.fd, fromName, to.fd, toName)
+	}
+	return renameat2(from.fd, fromName, to.fd, toName, flags)
+}
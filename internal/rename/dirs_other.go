@@ -0,0 +1,79 @@
+//go:build !linux
+
+package rename
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// dirHandle is a directory verified against its recorded identity. Without
+// the Linux *at calls, renames still go through full paths.
+type dirHandle struct {
+	path string
+}
+
+// openDirHandle verifies that the directory recorded in id is still the
+// same inode and not a symlink
+func openDirHandle(id dirIdentity) (*dirHandle, error) {
+	info, err := os.Lstat(id.real)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat directory %s: %w", id.real, err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.IsDir() || uint64(st.Dev) != id.dev || uint64(st.Ino) != id.ino {
+		return nil, fmt.Errorf("directory %s was replaced after validation", id.real)
+	}
+
+	return &dirHandle{path: id.real}, nil
+}
+
+// openDir opens a directory without following a final symlink
+func openDir(path string) (int, error) {
+	return syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+}
+
+// statDir stats a directory
+func statDir(path string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	return &st, syscall.Stat(path, &st)
+}
+
+// lstatPath stats path without following a final symlink
+func lstatPath(path string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	return &st, syscall.Lstat(path, &st)
+}
+
+// lstatAt stats the entry name in dir without following a symlink
+func lstatAt(dir *dirHandle, name string) (*syscall.Stat_t, error) {
+	return lstatPath(filepath.Join(dir.path, name))
+}
+
+func (h *dirHandle) close() {}
+
+// renameAt renames a name in one directory to a name in another. Rename
+// flags are only supported on Linux.
+func renameAt(from *dirHandle, fromName string, to *dirHandle, toName string, flags uintptr) error {
+	if flags != 0 {
+		return errNotSupported
+	}
+	return os.Rename(filepath.Join(from.path, fromName), filepath.Join(to.path, toName))
+}
+
+// readlinkAt reads the symlink name in dir
+func readlinkAt(dir *dirHandle, name string) (string, error) {
+	return os.Readlink(filepath.Join(dir.path, name))
+}
+
+// symlinkAt creates the symlink name in dir, pointing at target
+func symlinkAt(target string, dir *dirHandle, name string) error {
+	return os.Symlink(target, filepath.Join(dir.path, name))
+}
+
+// unlinkAt removes the file name from dir
+func unlinkAt(dir *dirHandle, name string) error {
+	return os.Remove(filepath.Join(dir.path, name))
+}
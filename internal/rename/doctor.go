@@ -0,0 +1,243 @@
+package rename
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Recovery describes how to repair the temp files left by interrupted runs
+type Recovery struct {
+	Plan       []RenameOp            // renames that restore stray temp files
+	Unresolved []string              // stray temp files that cannot be restored, with the reason
+	Sessions   []string              // sessions whose journals can be removed once Plan has run
+	Journals   map[string][]RenameOp // plans of the unfinished sessions
+}
+
+// RemoveJournals removes the journals of the sessions whose temp files are
+// all resolved. A session that still holds the locks on its directories is
+// running, not stranded, and keeps its journal. Directories that are gone
+// cannot be locked by anyone and are left out.
+func (r *Recovery) RemoveJournals() {
+	for _, session := range r.Sessions {
+		var paths []string
+		for _, op := range r.Journals[session] {
+			for _, path := range []string{op.From, op.To} {
+				if _, err := os.Stat(filepath.Dir(path)); err == nil {
+					paths = append(paths, path)
+				}
+			}
+		}
+
+		locks, err := LockDirs(paths)
+		if err != nil {
+			continue
+		}
+		RemoveJournal(session)
+		locks.Release()
+	}
+}
+
+// PlanRecovery finds stray gmv temp files in dirs, and in every directory
+// named by an unfinished journal, and works out where each belongs using
+// the journal, or the log, of the session that created it
+func PlanRecovery(dirs []string) (*Recovery, error) {
+	journals, err := readJournals()
+	if err != nil {
+		return nil, err
+	}
+
+	// Scan the requested directories plus those with journaled temp files.
+	// Journals hold absolute paths, so the requested directories are made
+	// absolute too, or a temp file in both would be found twice.
+	scan := make(map[string]bool)
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		scan[abs] = true
+	}
+	for _, plan := range journals {
+		for _, op := range plan {
+			for _, path := range []string{op.From, op.To} {
+				if strings.HasPrefix(filepath.Base(path), TempPrefix) {
+					scan[filepath.Dir(path)] = true
+				}
+			}
+		}
+	}
+
+	var strays []string
+	seen := make(map[string]bool)
+	for dir := range scan {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			stray := filepath.Join(dir, entry.Name())
+			if strings.HasPrefix(entry.Name(), TempPrefix) && !seen[stray] {
+				seen[stray] = true
+				strays = append(strays, stray)
+			}
+		}
+	}
+	sort.Strings(strays)
+
+	recovery := &Recovery{Journals: journals}
+	pending := make(map[string]bool)
+	claimed := make(map[string]bool)
+	exists := func(path string) bool {
+		if claimed[path] {
+			return true
+		}
+		_, err := os.Lstat(path)
+		return err == nil
+	}
+
+	for _, stray := range strays {
+		session := tempSession(stray)
+		if session == "" {
+			recovery.Unresolved = append(recovery.Unresolved, stray+": created by an older gmv without a session id")
+			continue
+		}
+
+		plan, ok := journals[session]
+		if !ok {
+			plan = findSessionLog(session)
+		}
+		if plan == nil {
+			recovery.Unresolved = append(recovery.Unresolved, stray+": no journal or log for session "+session)
+			pending[session] = true
+			continue
+		}
+
+		target, reason := restoreTarget(stray, plan, exists)
+		if target == "" {
+			recovery.Unresolved = append(recovery.Unresolved, stray+": "+reason)
+			pending[session] = true
+			continue
+		}
+		claimed[target] = true
+		recovery.Plan = append(recovery.Plan, RenameOp{From: stray, To: target})
+	}
+
+	for session := range journals {
+		if !pending[session] {
+			recovery.Sessions = append(recovery.Sessions, session)
+		}
+	}
+	sort.Strings(recovery.Sessions)
+
+	return recovery, nil
+}
+
+// restoreTarget decides where a stray temp file belongs: the name the plan
+// meant to give it, or failing that the name it had before
+func restoreTarget(stray string, plan []RenameOp, exists func(string) bool) (string, string) {
+	var intended, original string
+	for _, op := range plan {
+		if op.From == stray {
+			intended = op.To
+		}
+		if op.To == stray {
+			original = op.From
+		}
+	}
+
+	if intended == "" && original == "" {
+		// A temp file from an exchange done in three steps holds the first
+		// file of the exchange; it belongs on whichever side is missing
+		dir := filepath.Dir(stray)
+		var candidates []string
+		for _, op := range plan {
+			if op.Kind != OpExchange || filepath.Dir(op.From) != dir {
+				continue
+			}
+			if !exists(op.From) && exists(op.To) {
+				candidates = append(candidates, op.From)
+			} else if exists(op.From) && !exists(op.To) {
+				candidates = append(candidates, op.To)
+			}
+		}
+		if len(candidates) == 1 {
+			return candidates[0], ""
+		}
+
+		// A relink creates its new link under a temp name first
+		if target, err := os.Readlink(stray); err == nil {
+			for _, op := range plan {
+				if op.Kind == OpRelink && filepath.Dir(op.From) == dir && op.Target == target {
+					return "", "new link for " + op.From + " that was never put in place, safe to delete"
+				}
+			}
+		}
+		return "", "not found in the session's plan"
+	}
+
+	if intended != "" && !exists(intended) {
+		return intended, ""
+	}
+	if original != "" && !exists(original) {
+		return original, ""
+	}
+	return "", "both its intended and original names are taken"
+}
+
+// readJournals loads the plans of all unfinished sessions
+func readJournals() (map[string][]RenameOp, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	journals := make(map[string][]RenameOp)
+	for _, entry := range entries {
+		if plan, err := ReadLog(filepath.Join(dir, entry.Name())); err == nil {
+			journals[entry.Name()] = plan
+		}
+	}
+	return journals, nil
+}
+
+// findSessionLog returns the plan recorded in the log of a session, or nil
+func findSessionLog(session string) []RenameOp {
+	logs, _ := filepath.Glob(filepath.Join(os.TempDir(), "gmv-log-*"))
+	for _, logPath := range logs {
+		if logSession(logPath) == session {
+			if plan, err := ReadLog(logPath); err == nil {
+				return plan
+			}
+		}
+	}
+	return nil
+}
+
+// logSession reads the session id from a log header
+func logSession(logPath string) string {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if session, ok := strings.CutPrefix(line, "# Session: "); ok {
+			return session
+		}
+	}
+	return ""
+}
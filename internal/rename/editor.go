@@ -1,21 +1,33 @@
 package rename
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 )
 
+// ErrNoEditor is returned when neither $EDITOR nor a fallback editor is available
+var ErrNoEditor = errors.New("no editor found: $EDITOR not set and neither vi nor nano are available")
+
+// FindEditor returns $EDITOR, or vi or nano if $EDITOR is unset
+func FindEditor() (string, error) {
+	if editor := os.Getenv("EDITOR"); editor != "" {
+		return editor, nil
+	}
+	if _, err := exec.LookPath("vi"); err == nil {
+		return "vi", nil
+	}
+	if _, err := exec.LookPath("nano"); err == nil {
+		return "nano", nil
+	}
+	return "", ErrNoEditor
+}
+
 func LaunchEditor(filepath string) error {
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		if _, err := exec.LookPath("vi"); err == nil {
-			editor = "vi"
-		} else if _, err := exec.LookPath("nano"); err == nil {
-			editor = "nano"
-		} else {
-			return fmt.Errorf("no editor found: $EDITOR not set and neither vi nor nano are available")
-		}
+	editor, err := FindEditor()
+	if err != nil {
+		return err
 	}
 
 	// Launch the editor
@@ -1,39 +1,346 @@
 package rename
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
-// ExecuteRenames performs the rename operations or prints them in dry-run mode
+// errNotSupported is returned by the atomic rename primitives when the
+// platform or filesystem lacks them
+var errNotSupported = errors.New("operation not supported")
+
+// Flags for renameat2(2)
+const (
+	renameNoReplaceFlag = 1 << 0
+	renameExchangeFlag  = 1 << 1
+)
+
+// ExecOptions controls how a plan is executed
+type ExecOptions struct {
+	DryRun bool
+
+	// KeepGoing continues past failed operations, skipping only those that
+	// depend on a failure
+	KeepGoing bool
+
+	// Dirs holds the parent directories as they were at validation time.
+	// If nil, they are recorded when execution starts.
+	Dirs DirSnapshot
+	// Sources holds the files as they were when editing began. If set,
+	// nothing runs if one of them has been replaced, removed or modified.
+	Sources Fingerprints
+	// Stop, once closed, ends execution before the next operation that is
+	// not part of a group already under way
+	Stop <-chan struct{}
+	// Observer, if set, is told about every operation as it runs. In
+	// dry-run mode it only receives EventPlanned.
+	Observer Observer
+}
+
+// ErrInterrupted is returned when execution was stopped through Stop
+var ErrInterrupted = errors.New("interrupted")
+
+// OpError is an operation that failed, or one whose rollback failed
+type OpError struct {
+	Op       RenameOp
+	Err      error
+	Rollback bool
+}
+
+func (e *OpError) Error() string {
+	if e.Rollback {
+		return fmt.Sprintf("failed to roll back %s: %v", e.Op, e.Err)
+	}
+	switch e.Op.Kind {
+	case OpExchange:
+		return fmt.Sprintf("failed to exchange %s and %s: %v", e.Op.From, e.Op.To, e.Err)
+	case OpRelink:
+		return fmt.Sprintf("failed to point %s at %s: %v", e.Op.From, e.Op.Target, e.Err)
+	case OpAttrs:
+		return fmt.Sprintf("failed to change the attributes of %s: %v", e.Op.From, e.Err)
+	}
+	return fmt.Sprintf("failed to rename %s to %s: %v", e.Op.From, e.Op.To, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// ExecError reports a plan that did not fully run. Done holds the
+// operations that took effect, in order; operations of a group that were
+// undone after a later member failed are in RolledBack instead.
+type ExecError struct {
+	Done       []RenameOp
+	Failed     []*OpError
+	Skipped    []RenameOp // not attempted because they depend on a failure
+	RolledBack []RenameOp
+
+	// Interrupted is set when execution was stopped, leaving Pending unrun
+	Interrupted bool
+	Pending     []RenameOp
+}
+
+func (e *ExecError) Error() string {
+	switch {
+	case e.Interrupted:
+		return fmt.Sprintf("interrupted with %d operation(s) not run", len(e.Pending))
+	case len(e.Failed) == 1 && len(e.Skipped) == 0:
+		return e.Failed[0].Error()
+	}
+	return fmt.Sprintf("%d operation(s) failed and %d were skipped", len(e.Failed), len(e.Skipped))
+}
+
+func (e *ExecError) Unwrap() error {
+	if e.Interrupted {
+		return ErrInterrupted
+	}
+	return e.Failed[0]
+}
+
+// ExecuteRenames performs the rename operations, or only checks them in
+// dry-run mode, without reporting progress
 func ExecuteRenames(plan []RenameOp, dryRun bool) error {
+	return Execute(plan, ExecOptions{DryRun: dryRun})
+}
+
+// Execute performs the rename operations relative to their open parent
+// directories, after checking that none of those directories has been
+// replaced since validation. If an operation fails, the operations already
+// done in its group are rolled back and an *ExecError is returned, after
+// the rest of the plan has run if opts.KeepGoing is set.
+func Execute(plan []RenameOp, opts ExecOptions) error {
+	if opts.DryRun {
+		if err := opts.Sources.verify(plan, nil); err != nil {
+			return err
+		}
+		for _, op := range plan {
+			opts.notify(EventPlanned, op, nil)
+		}
+		return nil
+	}
+
+	if err := createStashDirs(plan); err != nil {
+		return err
+	}
+
+	dirs, err := openDirs(plan, opts.Dirs)
+	if err != nil {
+		return err
+	}
+	defer dirs.close()
+
+	if err := opts.Sources.verify(plan, dirs); err != nil {
+		return err
+	}
+
 	for _, op := range plan {
-		if dryRun {
-			fmt.Printf("%s -> %s\n", op.From, op.To)
+		opts.notify(EventPlanned, op, nil)
+	}
+
+	result := &ExecError{}
+	// Paths left in a state the rest of the plan does not expect
+	blocked := make(map[string]bool)
+	failedGroups := make(map[int]bool)
+	startedGroups := make(map[int]bool)
+
+	for i, op := range plan {
+		if stopped(opts.Stop) && (op.Group == 0 || !startedGroups[op.Group]) {
+			result.Interrupted = true
+			result.Pending = plan[i:]
+			break
+		}
+		startedGroups[op.Group] = true
+
+		if blocked[op.From] || blocked[op.To] || op.Group != 0 && failedGroups[op.Group] {
+			result.Skipped = append(result.Skipped, op)
+			blocked[op.From], blocked[op.To] = true, true
+			opts.notify(EventSkipped, op, nil)
+			continue
+		}
+
+		opts.notify(EventStarted, op, nil)
+		err := dirs.apply(op)
+		if err == nil {
+			result.Done = append(result.Done, op)
+			opts.notify(EventDone, op, nil)
+			continue
+		}
+
+		failure := &OpError{Op: op, Err: err}
+		result.Failed = append(result.Failed, failure)
+		opts.notify(EventFailed, op, failure)
+		blocked[op.From], blocked[op.To] = true, true
+		if op.Group != 0 {
+			failedGroups[op.Group] = true
+			dirs.rollback(result, op.Group, blocked, opts)
+		}
+		if !opts.KeepGoing {
+			return result
+		}
+	}
+
+	if len(result.Failed) > 0 || result.Interrupted {
+		return result
+	}
+	return nil
+}
+
+// stopped reports whether stop has been closed
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// rollback reverts, newest first, the done operations of group, so that a
+// cycle or a backup hop never stays half applied
+func (d dirSet) rollback(result *ExecError, group int, blocked map[string]bool, opts ExecOptions) {
+	var done []RenameOp
+	var undone []RenameOp
+	for _, op := range result.Done {
+		if op.Group == group {
+			undone = append(undone, op)
 		} else {
-			if err := os.Rename(op.From, op.To); err != nil {
-				return fmt.Errorf("failed to rename %s to %s: %w", op.From, op.To, err)
-			}
+			done = append(done, op)
+		}
+	}
+
+	for i := len(undone) - 1; i >= 0; i-- {
+		op := undone[i]
+		blocked[op.From], blocked[op.To] = true, true
+		if err := d.apply(op.reverse()); err != nil {
+			failure := &OpError{Op: op, Err: err, Rollback: true}
+			result.Failed = append(result.Failed, failure)
+			opts.notify(EventFailed, op, failure)
+			done = append(done, op)
+			continue
 		}
+		result.RolledBack = append(result.RolledBack, op)
+		opts.notify(EventRolledBack, op, nil)
+	}
+	result.Done = done
+}
+
+// apply performs one operation, never replacing an existing file unless
+// the user agreed to overwrite it
+func (d dirSet) apply(op RenameOp) error {
+	from, fromName := d.locate(op.From)
+	to, toName := d.locate(op.To)
+
+	switch {
+	case op.Kind == OpRelink:
+		return relinkAt(from, fromName, op.OldTarget, op.Target)
+	case op.Kind == OpAttrs:
+		return changeAttrs(filepath.Join(from.path, fromName), op.OldAttrs, op.Attrs)
+	case op.Kind == OpExchange:
+		return exchangeAt(from, fromName, to, toName)
+	case op.Overwrite:
+		return renameAt(from, fromName, to, toName, 0)
+	default:
+		return renameNoClobberAt(from, fromName, to, toName)
+	}
+}
+
+// renameNoClobberAt renames without replacing an existing target. Where
+// RENAME_NOREPLACE is unavailable the check and the rename are separate
+// steps, which narrows but cannot close the race.
+func renameNoClobberAt(from *dirHandle, fromName string, to *dirHandle, toName string) error {
+	err := renameAt(from, fromName, to, toName, renameNoReplaceFlag)
+	if err != errNotSupported {
+		return err
+	}
+
+	if _, err := os.Lstat(filepath.Join(to.path, toName)); err == nil {
+		return fs.ErrExist
+	}
+	return renameAt(from, fromName, to, toName, 0)
+}
+
+// exchangeAt swaps two entries, atomically where RENAME_EXCHANGE is
+// available and through a temp file otherwise
+func exchangeAt(a *dirHandle, aName string, b *dirHandle, bName string) error {
+	err := renameAt(a, aName, b, bName, renameExchangeFlag)
+	if err != errNotSupported {
+		return err
+	}
+
+	tempName := filepath.Base(tempName(a.path, nil))
+	if err := renameNoClobberAt(a, aName, a, tempName); err != nil {
+		return err
+	}
+	if err := renameNoClobberAt(b, bName, a, aName); err != nil {
+		renameAt(a, tempName, a, aName, 0)
+		return err
+	}
+	if err := renameNoClobberAt(a, tempName, b, bName); err != nil {
+		renameAt(a, aName, b, bName, 0)
+		renameAt(a, tempName, a, aName, 0)
+		return err
+	}
+	return nil
+}
+
+// relinkAt points the symlink name at target, provided it still points at
+// oldTarget, by renaming a new temp link over it
+func relinkAt(dir *dirHandle, name, oldTarget, target string) error {
+	current, err := readlinkAt(dir, name)
+	if err != nil {
+		return err
+	}
+	if current != oldTarget {
+		return fmt.Errorf("link now points to %s", current)
+	}
+
+	tempName := filepath.Base(tempName(dir.path, nil))
+	if err := symlinkAt(target, dir, tempName); err != nil {
+		return err
+	}
+	if err := renameAt(dir, tempName, dir, name, 0); err != nil {
+		unlinkAt(dir, tempName)
+		return err
 	}
 	return nil
 }
 
 // WriteLog creates a log file with all rename operations
 func WriteLog(plan []RenameOp) (string, error) {
+	logPath, err := CreateLog()
+	if err != nil {
+		return "", err
+	}
+
+	if err := AppendLog(logPath, "", plan); err != nil {
+		return "", err
+	}
+
+	return logPath, nil
+}
+
+// CreateLog creates an empty log file with a header and returns its path
+func CreateLog() (string, error) {
 	// Get current working directory
 	cwd, err := os.Getwd()
 	if err != nil {
 		cwd = "unknown"
 	}
 
-	// Create log file
+	// Create log file, never replacing the log of an earlier run
 	timestamp := time.Now().Format("20060102-150405")
 	logPath := filepath.Join(os.TempDir(), fmt.Sprintf("gmv-log-%s", timestamp))
 
-	logFile, err := os.Create(logPath)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	for n := 1; os.IsExist(err); n++ {
+		logPath = filepath.Join(os.TempDir(), fmt.Sprintf("gmv-log-%s-%d", timestamp, n))
+		logFile, err = os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to create log file: %w", err)
 	}
@@ -41,19 +348,85 @@ func WriteLog(plan []RenameOp) (string, error) {
 
 	// Write header
 	header := fmt.Sprintf("# gmv operation log - %s\n", time.Now().Format("2006-01-02 15:04:05"))
+	header += fmt.Sprintf("# Session: %s\n", SessionID)
 	header += fmt.Sprintf("# Working directory: %s\n\n", cwd)
 
 	if _, err := logFile.WriteString(header); err != nil {
 		return "", fmt.Errorf("failed to write log header: %w", err)
 	}
 
-	// Write operations
-	for _, op := range plan {
-		line := fmt.Sprintf("%s -> %s\n", op.From, op.To)
-		if _, err := logFile.WriteString(line); err != nil {
-			return "", fmt.Errorf("failed to write log entry: %w", err)
+	return logPath, nil
+}
+
+// AppendLog adds rename operations to an existing log, preceded by a
+// heading comment if one is given
+func AppendLog(logPath, heading string, plan []RenameOp) error {
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	if heading != "" {
+		if _, err := logFile.WriteString(fmt.Sprintf("# %s\n", heading)); err != nil {
+			return fmt.Errorf("failed to write log entry: %w", err)
 		}
 	}
 
-	return logPath, nil
+	// Write operations, each group preceded by its size so that undo can
+	// revert it as a whole
+	var b strings.Builder
+	for i, op := range plan {
+		if op.Group != 0 && (i == 0 || plan[i-1].Group != op.Group) {
+			n := 1
+			for n < len(plan)-i && plan[i+n].Group == op.Group {
+				n++
+			}
+			if n > 1 {
+				fmt.Fprintf(&b, "%s%d\n", groupComment, n)
+			}
+		}
+		b.WriteString(op.String() + "\n")
+	}
+	if _, err := logFile.WriteString(b.String()); err != nil {
+		return fmt.Errorf("failed to write log entry: %w", err)
+	}
+
+	return nil
+}
+
+// groupComment precedes the operations of a group in a log, with their count
+const groupComment = "# group of "
+
+// AppendFailures records in a log, as comments, the operations of a plan
+// that failed, were skipped, were rolled back or were not run
+func AppendFailures(logPath string, e *ExecError) error {
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	var b strings.Builder
+	for _, failure := range e.Failed {
+		if failure.Rollback {
+			fmt.Fprintf(&b, "# rollback failed: %s: %v\n", failure.Op, failure.Err)
+		} else {
+			fmt.Fprintf(&b, "# failed: %s: %v\n", failure.Op, failure.Err)
+		}
+	}
+	for _, op := range e.Skipped {
+		fmt.Fprintf(&b, "# skipped: %s\n", op)
+	}
+	for _, op := range e.RolledBack {
+		fmt.Fprintf(&b, "# rolled back: %s\n", op)
+	}
+	for _, op := range e.Pending {
+		fmt.Fprintf(&b, "# not run: %s\n", op)
+	}
+
+	if _, err := logFile.WriteString(b.String()); err != nil {
+		return fmt.Errorf("failed to write log entry: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,97 @@
+package rename
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fingerprint identifies the file a name referred to when editing began
+type fingerprint struct {
+	dev, ino uint64
+	size     int64
+	mtime    time.Time
+	dir      bool
+}
+
+// Fingerprints records the files being renamed, so that execution can
+// refuse to act on a name that now refers to a different or modified file
+type Fingerprints map[string]fingerprint
+
+// FingerprintFiles records the device, inode, size and modification time
+// of each file, without following symlinks
+func FingerprintFiles(files []string) (Fingerprints, error) {
+	prints := make(Fingerprints)
+	for _, file := range files {
+		print, err := fingerprintOf(file)
+		if err != nil {
+			return nil, err
+		}
+		prints[file] = print
+	}
+	return prints, nil
+}
+
+func fingerprintOf(path string) (fingerprint, error) {
+	st, err := lstatPath(path)
+	if err != nil {
+		return fingerprint{}, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	return fingerprintStat(st), nil
+}
+
+func fingerprintStat(st *syscall.Stat_t) fingerprint {
+	return fingerprint{
+		dev:   uint64(st.Dev),
+		ino:   uint64(st.Ino),
+		size:  st.Size,
+		mtime: modTime(st),
+		dir:   uint32(st.Mode)&syscall.S_IFMT == syscall.S_IFDIR,
+	}
+}
+
+// verify checks that every recorded source in plan is still the file that
+// was fingerprinted, looking it up through its open directory in dirs if
+// given. A directory only has to be the same inode, since its size and
+// time change whenever an entry inside it does.
+func (f Fingerprints) verify(plan []RenameOp, dirs dirSet) error {
+	var changes []string
+	for _, op := range plan {
+		paths := []string{op.From}
+		if op.Kind == OpExchange {
+			paths = append(paths, op.To)
+		}
+
+		for _, path := range paths {
+			before, ok := f[path]
+			if !ok {
+				continue
+			}
+			var after fingerprint
+			var err error
+			if dir, name := dirs.locate(path); dir != nil {
+				var st *syscall.Stat_t
+				if st, err = lstatAt(dir, name); err == nil {
+					after = fingerprintStat(st)
+				}
+			} else {
+				after, err = fingerprintOf(path)
+			}
+			switch {
+			case err != nil:
+				changes = append(changes, path+" was removed")
+			case after.dev != before.dev || after.ino != before.ino:
+				changes = append(changes, path+" was replaced by another file")
+			case !before.dir && (after.size != before.size || !after.mtime.Equal(before.mtime)):
+				changes = append(changes, path+" was modified")
+			}
+		}
+	}
+
+	if len(changes) > 0 {
+		return fmt.Errorf("files changed since editing began, nothing was renamed:\n  - %s", strings.Join(changes, "\n  - "))
+	}
+	return nil
+}
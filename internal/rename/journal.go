@@ -0,0 +1,113 @@
+package rename
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// TempPrefix starts the name of every temp file gmv creates
+const TempPrefix = ".gmv_temp_"
+
+// SessionID identifies this run of gmv. It is encoded in temp file names
+// and recorded in the journal and log, so stray temp files can be traced
+// back to the plan that created them.
+var SessionID = newSessionID()
+
+var tempCounter atomic.Uint64
+
+func newSessionID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", os.Getpid())
+	}
+	return hex.EncodeToString(b)
+}
+
+// tempName returns an unused temp file path in dir that is not in taken
+func tempName(dir string, taken map[string]bool) string {
+	for {
+		name := filepath.Join(dir, fmt.Sprintf("%s%s_%d", TempPrefix, SessionID, tempCounter.Add(1)))
+		if taken[name] {
+			continue
+		}
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// tempSession returns the session encoded in a temp file name, or "" if
+// the name is not a gmv temp file with a session
+func tempSession(path string) string {
+	rest, ok := strings.CutPrefix(filepath.Base(path), TempPrefix)
+	if !ok {
+		return ""
+	}
+	session, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return ""
+	}
+	return session
+}
+
+func journalDir() (string, error) {
+	stateDir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(stateDir, "journal")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	return dir, nil
+}
+
+func journalPath(session string) (string, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, session), nil
+}
+
+// WriteJournal records plan before it runs, so that an interrupted run can
+// be repaired by gmv doctor. It uses the log format.
+func WriteJournal(plan []RenameOp) error {
+	path, err := journalPath(SessionID)
+	if err != nil {
+		return err
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = "unknown"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# gmv journal\n# Session: %s\n# Working directory: %s\n\n", SessionID, cwd)
+	for _, op := range plan {
+		b.WriteString(op.String() + "\n")
+	}
+
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+// RemoveJournal deletes the journal of a session once its plan has run
+func RemoveJournal(session string) error {
+	path, err := journalPath(session)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	return nil
+}
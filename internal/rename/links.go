@@ -0,0 +1,323 @@
+package rename
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// linkMapper maps paths from before a rename to after it. Paths are matched
+// with their parent directories resolved, so a link reaching a file through
+// a symlinked directory is still found.
+type linkMapper struct {
+	moves map[string]string // real path of a source -> its new base name
+	real  map[string]string // cache of resolved directories
+}
+
+func newLinkMapper(original, edited []string) (*linkMapper, error) {
+	m := &linkMapper{moves: make(map[string]string), real: make(map[string]string)}
+	for i := range original {
+		if original[i] == edited[i] {
+			continue
+		}
+		abs, err := filepath.Abs(original[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", original[i], err)
+		}
+		m.moves[m.realPath(abs)] = filepath.Base(edited[i])
+	}
+	return m, nil
+}
+
+// realPath resolves the symlinks in the directory part of an absolute path
+func (m *linkMapper) realPath(path string) string {
+	dir := filepath.Dir(path)
+	real, ok := m.real[dir]
+	if !ok {
+		var err error
+		if real, err = filepath.EvalSymlinks(dir); err != nil {
+			real = dir
+		}
+		m.real[dir] = real
+	}
+	return filepath.Join(real, filepath.Base(path))
+}
+
+// source returns the real path of the renamed file that the absolute path
+// is, or lies inside, and whether there is one
+func (m *linkMapper) source(path string) (string, bool) {
+	for source := m.realPath(path); ; source = filepath.Dir(source) {
+		if _, ok := m.moves[source]; ok {
+			return source, true
+		}
+		if source == filepath.Dir(source) {
+			return "", false
+		}
+	}
+}
+
+// apply returns where the absolute path will be once the renames have run,
+// and whether it moves at all
+func (m *linkMapper) apply(path string) (string, bool) {
+	source, ok := m.source(path)
+	if !ok {
+		return path, false
+	}
+	rest := strings.TrimPrefix(m.realPath(path), source)
+	if !strings.HasSuffix(path, rest) {
+		return path, false
+	}
+	prefix := strings.TrimSuffix(path, rest)
+	return filepath.Join(filepath.Dir(prefix), m.moves[source]) + rest, true
+}
+
+// FixLinks finds the symlinks under root that point at a renamed file, or
+// at anything inside a renamed directory, and adds to plan, the plan of
+// those renames, the operations that point them at the new names. A relink
+// uses the link's current path and runs just before the renames it depends
+// on, in one group with them, so that it is rolled back or skipped if one
+// of them fails. A relative link stays relative to where it will be once
+// the renames have run.
+func FixLinks(root string, original, edited []string, plan []RenameOp) ([]RenameOp, error) {
+	mapper, err := newLinkMapper(original, edited)
+	if err != nil {
+		return nil, err
+	}
+
+	var relinks []RenameOp
+	var needs [][]string // the sources each relink depends on
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// Unreadable parts of the tree are left alone
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink == 0 || strings.HasPrefix(d.Name(), TempPrefix) {
+			return nil
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil
+		}
+		link, err := filepath.Abs(path)
+		if err != nil {
+			return nil
+		}
+
+		resolved := target
+		if !filepath.IsAbs(target) {
+			resolved = filepath.Join(filepath.Dir(link), target)
+		}
+		resolved = filepath.Clean(resolved)
+		moved, ok := mapper.apply(resolved)
+		if !ok {
+			return nil
+		}
+
+		newTarget := moved
+		if !filepath.IsAbs(target) {
+			newLink, _ := mapper.apply(link)
+			if newTarget, err = filepath.Rel(filepath.Dir(newLink), moved); err != nil {
+				return nil
+			}
+		}
+		if newTarget != target {
+			relinks = append(relinks, RenameOp{From: path, To: path, Kind: OpRelink, OldTarget: target, Target: newTarget})
+			need, _ := mapper.source(resolved)
+			if source, ok := mapper.source(link); ok {
+				needs = append(needs, []string{need, source})
+			} else {
+				needs = append(needs, []string{need})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s for links: %w", root, err)
+	}
+
+	return mapper.addRelinks(plan, relinks, needs), nil
+}
+
+// addRelinks returns plan with each relink placed before the renames of the
+// sources it needs. Those renames, the groups they belong to and whatever
+// runs between them become one group with the relink.
+func (m *linkMapper) addRelinks(plan, relinks []RenameOp, needs [][]string) []RenameOp {
+	// The first operation that moves each source away
+	moves := make(map[string]int)
+	for i, op := range plan {
+		paths := []string{op.From}
+		switch op.Kind {
+		case OpRename:
+		case OpExchange:
+			paths = append(paths, op.To)
+		default:
+			continue
+		}
+		for _, path := range paths {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				continue
+			}
+			if _, ok := moves[m.realPath(abs)]; !ok {
+				moves[m.realPath(abs)] = i
+			}
+		}
+	}
+
+	type span struct {
+		first, last int // the operations of plan the relinks need
+		relinks     []RenameOp
+	}
+	var spans []span
+	var unplaced []RenameOp
+	for k, relink := range relinks {
+		s := span{first: -1, relinks: []RenameOp{relink}}
+		for _, source := range needs[k] {
+			i, ok := moves[source]
+			if !ok {
+				continue
+			}
+			first, last := groupSpan(plan, i)
+			if s.first < 0 || first < s.first {
+				s.first = first
+			}
+			s.last = max(s.last, last)
+		}
+		if s.first < 0 {
+			unplaced = append(unplaced, relink)
+			continue
+		}
+		spans = append(spans, s)
+	}
+
+	// Overlapping spans become one
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].first < spans[j].first })
+	var merged []span
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s.first <= merged[n-1].last {
+			merged[n-1].last = max(merged[n-1].last, s.last)
+			merged[n-1].relinks = append(merged[n-1].relinks, s.relinks...)
+			continue
+		}
+		merged = append(merged, s)
+	}
+
+	result := unplaced
+	group := nextGroup(plan)
+	next := 0
+	for _, s := range merged {
+		result = append(result, plan[next:s.first]...)
+		id := plan[s.first].Group
+		if id == 0 || plan[s.last].Group != id {
+			id = group
+			group++
+		}
+		for _, relink := range s.relinks {
+			relink.Group = id
+			result = append(result, relink)
+		}
+		for _, op := range plan[s.first : s.last+1] {
+			op.Group = id
+			result = append(result, op)
+		}
+		next = s.last + 1
+	}
+	return append(result, plan[next:]...)
+}
+
+// groupSpan returns the first and last operations of the group that the
+// operation i of plan belongs to
+func groupSpan(plan []RenameOp, i int) (int, int) {
+	first, last := i, i
+	if group := plan[i].Group; group != 0 {
+		for first > 0 && plan[first-1].Group == group {
+			first--
+		}
+		for last < len(plan)-1 && plan[last+1].Group == group {
+			last++
+		}
+	}
+	return first, last
+}
+
+// ReadLinks returns the target of each of files, which must all be symlinks
+func ReadLinks(files []string) ([]string, error) {
+	targets := make([]string, len(files))
+	for i, file := range files {
+		info, err := os.Lstat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return nil, fmt.Errorf("%s is not a symlink", file)
+		}
+		if targets[i], err = os.Readlink(file); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// LinkLines returns the editor lines for editing links: each name followed
+// by " -> " and its target
+func LinkLines(names, targets []string) []string {
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + " -> " + targets[i]
+	}
+	return lines
+}
+
+// SplitLinkLines parses edited "link -> target" lines into names and
+// targets. A link name cannot contain " -> ", but a target can.
+func SplitLinkLines(lines []string) (names, targets []string, err error) {
+	for i, line := range lines {
+		name, target, err := splitLinkLine(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		names = append(names, name)
+		targets = append(targets, target)
+	}
+	return names, targets, nil
+}
+
+func splitLinkLine(line string) (name, target string, err error) {
+	name, target, ok := strings.Cut(line, " -> ")
+	if !ok || strings.TrimSpace(target) == "" {
+		return "", "", fmt.Errorf("not of the form \"link -> target\": %s", line)
+	}
+	if strings.ContainsRune(target, 0) {
+		return "", "", fmt.Errorf("link target contains a NUL byte: %q", target)
+	}
+	return strings.TrimSpace(name), strings.TrimSpace(target), nil
+}
+
+// LinkConflicts is Conflicts for the "link -> target" lines of
+// --edit-links: only the names are checked as paths
+func LinkConflicts(files, lines []string) []LineConflict {
+	return lineConflicts(files, lines, func(i int, line string) (string, error) {
+		name, _, err := splitLinkLine(line)
+		return name, err
+	})
+}
+
+// RelinkPlan returns the operations that point each link in files whose
+// target was edited at its new target. Like those of FixLinks, they use the
+// links' current paths and must run before the renames.
+func RelinkPlan(files, oldTargets, newTargets []string) []RenameOp {
+	var plan []RenameOp
+	for i, file := range files {
+		if newTargets[i] != oldTargets[i] {
+			plan = append(plan, RenameOp{From: file, To: file, Kind: OpRelink, OldTarget: oldTargets[i], Target: newTargets[i]})
+		}
+	}
+	return plan
+}
@@ -0,0 +1,173 @@
+package rename
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DirLocks holds advisory locks on the directories of a rename session
+type DirLocks struct {
+	fds   []int
+	infos []string
+	held  map[string]bool // resolved paths of the locked directories
+}
+
+// lockInfoDir holds, for each locked directory, who holds the lock. It is
+// shared by all users, like the temp dir it lives in.
+func lockInfoDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), "gmv-locks")
+	if err := os.Mkdir(dir, 0777|os.ModeSticky); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	os.Chmod(dir, 0777|os.ModeSticky)
+	return dir, nil
+}
+
+// LockDirs takes an exclusive flock on the parent directory of each file,
+// in order of their resolved paths so that two sessions cannot deadlock.
+// If another session holds one of the locks, everything taken so far is
+// released and the error names the holder.
+func LockDirs(files []string) (*DirLocks, error) {
+	locks := &DirLocks{}
+	if err := locks.Lock(files); err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+// Lock adds the parent directories of files that are not held yet, such as
+// those of a plan that reaches beyond the files being renamed. If another
+// session holds one of them, the locks taken by this call are released and
+// the earlier ones kept.
+func (l *DirLocks) Lock(files []string) error {
+	infoDir, err := lockInfoDir()
+	if err != nil {
+		return err
+	}
+
+	snapshot := make(DirSnapshot)
+	var dirs []string
+	for _, file := range files {
+		id, err := snapshot.identify(existingDir(parentDir(file)))
+		if err != nil {
+			return err
+		}
+		if !l.held[id.real] {
+			dirs = append(dirs, id.real)
+		}
+	}
+	sort.Strings(dirs)
+
+	taken := &DirLocks{}
+	for i, dir := range dirs {
+		if i > 0 && dir == dirs[i-1] {
+			continue
+		}
+
+		fd, err := openDir(dir)
+		if err != nil {
+			taken.Release()
+			return fmt.Errorf("failed to open directory %s: %w", dir, err)
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			syscall.Close(fd)
+			taken.Release()
+			return fmt.Errorf("failed to stat directory %s: %w", dir, err)
+		}
+		info := filepath.Join(infoDir, fmt.Sprintf("%d-%d", uint64(st.Dev), uint64(st.Ino)))
+
+		if err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			syscall.Close(fd)
+			taken.Release()
+			if err == syscall.EWOULDBLOCK {
+				return fmt.Errorf("directory %s is in use by another gmv session (%s)", dir, lockHolder(info))
+			}
+			return fmt.Errorf("failed to lock directory %s: %w", dir, err)
+		}
+
+		taken.fds = append(taken.fds, fd)
+		if writeLockInfo(info) == nil {
+			taken.infos = append(taken.infos, info)
+		}
+	}
+
+	if l.held == nil {
+		l.held = make(map[string]bool)
+	}
+	for _, dir := range dirs {
+		l.held[dir] = true
+	}
+	l.fds = append(l.fds, taken.fds...)
+	l.infos = append(l.infos, taken.infos...)
+	return nil
+}
+
+// existingDir returns dir, or if it does not exist yet, such as a stash
+// directory created when the plan runs, its nearest ancestor that does
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// Release drops the locks and their holder information
+func (l *DirLocks) Release() {
+	if l == nil {
+		return
+	}
+	for _, info := range l.infos {
+		os.Remove(info)
+	}
+	for _, fd := range l.fds {
+		syscall.Close(fd)
+	}
+	l.fds, l.infos, l.held = nil, nil, nil
+}
+
+// writeLockInfo records this process as the holder of a lock
+func writeLockInfo(path string) error {
+	name := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	os.Remove(path)
+	content := fmt.Sprintf("%s %d %s\n", name, os.Getpid(), time.Now().Format(time.RFC3339))
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+// lockHolder describes the holder recorded for a lock, if it is still
+// running
+func lockHolder(path string) string {
+	content, err := os.ReadFile(path)
+	fields := strings.Fields(string(content))
+	if err != nil || len(fields) != 3 {
+		return "holder unknown"
+	}
+
+	pid, err := strconv.Atoi(fields[1])
+	if err != nil || syscall.Kill(pid, 0) == syscall.ESRCH {
+		return "holder unknown"
+	}
+
+	since := fields[2]
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		since = t.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprintf("user %s, pid %d, since %s", fields[0], pid, since)
+}
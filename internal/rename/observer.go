@@ -0,0 +1,40 @@
+package rename
+
+// EventKind says what happened to an operation
+type EventKind int
+
+const (
+	EventPlanned    EventKind = iota // the operation is part of the plan; sent for every operation first
+	EventStarted                     // the operation is about to run
+	EventDone                        // the operation took effect
+	EventFailed                      // the operation, or its rollback, failed
+	EventSkipped                     // the operation depends on a failure and was not attempted
+	EventRolledBack                  // the operation was undone after another in its group failed
+)
+
+// Event reports progress on one operation of a plan
+type Event struct {
+	Kind EventKind
+	Op   RenameOp
+	Err  *OpError // for EventFailed
+}
+
+// Observer receives the events of an execution, in order, from the
+// goroutine that runs it
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc adapts a function to an Observer
+type ObserverFunc func(Event)
+
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// notify sends an event to the observer, if there is one
+func (o ExecOptions) notify(kind EventKind, op RenameOp, err *OpError) {
+	if o.Observer != nil {
+		o.Observer.Observe(Event{Kind: kind, Op: op, Err: err})
+	}
+}
@@ -1,13 +1,94 @@
 package rename
 
 import (
-	"fmt"
 	"path/filepath"
-	"time"
+	"sort"
 )
 
-// BuildRenamePlan creates a plan for renaming files, handling cycles with temp files
+// BuildRenamePlan creates a plan for renaming files, handling swaps with an
+// exchange and longer cycles with temp files. In case-insensitive
+// directories, renames that only change the case of a name go through a
+// temp file.
 func BuildRenamePlan(original, edited []string) ([]RenameOp, error) {
+	detectCaseFolding(original)
+
+	// A target differing only in case from an original names that
+	// original's entry, so plan with the original's spelling and put the
+	// edited one back afterwards
+	planned := edited
+	spelling := make(map[string]string) // original -> edited spelling
+	var caseOnly []int
+	byFold := make(map[string]string)
+	for _, file := range original {
+		byFold[foldPath(file)] = file
+	}
+	for i := range original {
+		if edited[i] == original[i] {
+			continue
+		}
+		file, ok := byFold[foldPath(edited[i])]
+		if !ok || file == edited[i] {
+			continue
+		}
+		if len(spelling) == 0 && len(caseOnly) == 0 {
+			planned = append([]string(nil), edited...)
+		}
+		planned[i] = file
+		if file == original[i] {
+			caseOnly = append(caseOnly, i)
+		} else {
+			spelling[file] = edited[i]
+		}
+	}
+
+	plan, err := buildPlan(original, planned)
+	if err != nil || len(spelling) == 0 && len(caseOnly) == 0 {
+		return plan, err
+	}
+
+	taken := make(map[string]bool)
+	for i := range original {
+		taken[original[i]] = true
+		taken[edited[i]] = true
+	}
+	group := nextGroup(plan)
+	var finalPlan []RenameOp
+	for _, op := range plan {
+		if op.Kind != OpExchange {
+			if to, ok := spelling[op.To]; ok {
+				op.To = to
+			}
+			finalPlan = append(finalPlan, op)
+			continue
+		}
+
+		// An exchange keeps both names as they are, so respell them after
+		_, respellTo := spelling[op.To]
+		_, respellFrom := spelling[op.From]
+		if !respellTo && !respellFrom {
+			finalPlan = append(finalPlan, op)
+			continue
+		}
+		op.Group = group
+		finalPlan = append(finalPlan, op)
+		for _, file := range []string{op.To, op.From} {
+			if to, ok := spelling[file]; ok {
+				finalPlan = append(finalPlan, caseHop(file, to, group, taken)...)
+			}
+		}
+		group++
+	}
+	for _, i := range caseOnly {
+		finalPlan = append(finalPlan, caseHop(original[i], edited[i], group, taken)...)
+		group++
+	}
+
+	return finalPlan, nil
+}
+
+// buildPlan orders the renames from original to edited, taking names as
+// exact strings
+func buildPlan(original, edited []string) ([]RenameOp, error) {
 	initialPlan := []RenameOp{}
 	renameMap := make(map[string]string) // from -> to mapping
 
@@ -27,23 +108,37 @@ func BuildRenamePlan(original, edited []string) ([]RenameOp, error) {
 	// Detect cycles
 	cycles := DetectCycles(initialPlan)
 
-	// If no cycles, return the initial plan
-	if len(cycles) == 0 {
-		return initialPlan, nil
-	}
-
-	// Handle cycles by using temp files
+	// Handle cycles by using temp files, named so that they cannot collide
+	// with each other, with any file in the plan or with a file on disk
 	finalPlan := []RenameOp{}
 	handledInCycle := make(map[string]bool)
+	taken := make(map[string]bool)
+	for i := range original {
+		taken[original[i]] = true
+		taken[edited[i]] = true
+	}
 
 	for _, cycle := range cycles {
 		if len(cycle) == 0 {
 			continue
 		}
 
+		// A swap of two files is a single atomic exchange
+		if len(cycle) == 2 {
+			handledInCycle[cycle[0]] = true
+			handledInCycle[cycle[1]] = true
+			finalPlan = append(finalPlan, RenameOp{
+				From: cycle[0],
+				To:   cycle[1],
+				Kind: OpExchange,
+			})
+			continue
+		}
+
 		firstFile := cycle[0]
-		dir := filepath.Dir(firstFile)
-		tempName := filepath.Join(dir, fmt.Sprintf(".gmv_temp_%d", time.Now().UnixNano()))
+		group := nextGroup(finalPlan)
+		tempName := tempName(filepath.Dir(firstFile), taken)
+		taken[tempName] = true
 
 		// Mark all files in cycle as handled
 		for _, file := range cycle {
@@ -52,8 +147,9 @@ func BuildRenamePlan(original, edited []string) ([]RenameOp, error) {
 
 		// Step 1: Move first file to temp (breaks the cycle)
 		finalPlan = append(finalPlan, RenameOp{
-			From: firstFile,
-			To:   tempName,
+			From:  firstFile,
+			To:    tempName,
+			Group: group,
 		})
 
 		// Step 2: Process from LAST to SECOND in the cycle
@@ -62,28 +158,87 @@ func BuildRenamePlan(original, edited []string) ([]RenameOp, error) {
 			from := cycle[i]
 			to := renameMap[from]
 			finalPlan = append(finalPlan, RenameOp{
-				From: from,
-				To:   to,
+				From:  from,
+				To:    to,
+				Group: group,
 			})
 		}
 
 		// Step 3: Move temp to the first file's target
 		finalPlan = append(finalPlan, RenameOp{
-			From: tempName,
-			To:   renameMap[firstFile],
+			From:  tempName,
+			To:    renameMap[firstFile],
+			Group: group,
 		})
 	}
 
-	// Add non-cycle operations
+	// Add non-cycle operations. In a chain (a -> b, b -> c) the target of
+	// each rename must be vacated first, so follow each chain to its end and
+	// add it back to front.
+	byFrom := make(map[string]RenameOp)
 	for _, op := range initialPlan {
 		if !handledInCycle[op.From] {
-			finalPlan = append(finalPlan, op)
+			byFrom[op.From] = op
+		}
+	}
+
+	added := make(map[string]bool)
+	for _, op := range initialPlan {
+		if handledInCycle[op.From] {
+			continue
+		}
+
+		var chain []RenameOp
+		for cur, ok := op, true; ok && !added[cur.From]; cur, ok = byFrom[cur.To] {
+			added[cur.From] = true
+			chain = append(chain, cur)
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			finalPlan = append(finalPlan, chain[i])
 		}
 	}
 
 	return finalPlan, nil
 }
 
+// SkipRenames drops the renames at the given indexes from an edit. Renames
+// that can no longer happen because they depended on a skipped one (the
+// next link of a chain, or the rest of a cycle) are dropped as well; their
+// indexes are returned in cascaded, in ascending order.
+func SkipRenames(original, edited []string, skip map[int]bool) (result []string, cascaded []int) {
+	result = make([]string, len(edited))
+	copy(result, edited)
+	for i := range skip {
+		result[i] = original[i]
+	}
+
+	// A rename must be dropped if its target is an original that stays put
+	detectCaseFolding(original)
+	for {
+		staying := make(map[string]bool)
+		for i := range original {
+			if result[i] == original[i] {
+				staying[foldPath(original[i])] = true
+			}
+		}
+
+		changed := false
+		for i := range result {
+			if result[i] != original[i] && staying[foldPath(result[i])] {
+				result[i] = original[i]
+				cascaded = append(cascaded, i)
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	sort.Ints(cascaded)
+	return result, cascaded
+}
+
 // DetectCycles finds cycles in rename operations using DFS
 func DetectCycles(plan []RenameOp) [][]string {
 	// Build adjacency map: from -> to
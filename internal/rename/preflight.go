@@ -0,0 +1,115 @@
+package rename
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Access modes for access(2)
+const (
+	accessWrite  = 0x2
+	accessSearch = 0x1
+)
+
+// Preflight checks every operation in plan against the conditions that
+// would make it fail part way through: a parent directory that is not
+// writable, read-only, immutable or append-only, an entry protected by a
+// sticky directory or by its own immutable or append-only flag, and a mount
+// point. It returns every problem found, so they can be fixed at once.
+func Preflight(plan []RenameOp) []string {
+	var blockers []string
+	seen := make(map[string]bool)
+	report := func(format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		if !seen[message] {
+			seen[message] = true
+			blockers = append(blockers, message)
+		}
+	}
+
+	checked := make(map[string]bool)
+	for _, op := range plan {
+		// Attributes are changed on the file, not in its directory
+		if op.Kind == OpAttrs {
+			continue
+		}
+
+		for _, dir := range []string{parentDir(op.From), parentDir(op.To)} {
+			if !checked[dir] {
+				checked[dir] = true
+				checkDir(dir, report)
+			}
+		}
+
+		// An exchange or an overwrite also moves or removes the target
+		moved := []string{op.From}
+		if op.Kind == OpExchange || op.Overwrite {
+			moved = append(moved, op.To)
+		}
+		for _, path := range moved {
+			checkEntry(path, report)
+		}
+	}
+
+	return blockers
+}
+
+// checkDir reports why entries of dir could not be renamed. Directories
+// that do not exist yet, such as a stash, are skipped.
+func checkDir(dir string, report func(string, ...any)) {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return
+	}
+
+	switch err := syscall.Access(dir, accessWrite|accessSearch); {
+	case errors.Is(err, syscall.EROFS):
+		report("%s is on a read-only filesystem", dir)
+	case errors.Is(err, syscall.EACCES):
+		report("no write permission in directory %s", dir)
+	}
+
+	immutable, appendOnly := fileFlags(dir, info)
+	if immutable {
+		report("directory %s is immutable", dir)
+	} else if appendOnly {
+		report("directory %s is append-only", dir)
+	}
+}
+
+// checkEntry reports why path itself could not be renamed
+func checkEntry(path string, report func(string, ...any)) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+
+	immutable, appendOnly := fileFlags(path, info)
+	if immutable {
+		report("%s is immutable", path)
+	} else if appendOnly {
+		report("%s is append-only", path)
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	parent, err := statDir(parentDir(path))
+	if err != nil {
+		return
+	}
+
+	// In a sticky directory only the owner of an entry or of the directory
+	// may rename it
+	uid := uint32(os.Getuid())
+	if parent.Mode&syscall.S_ISVTX != 0 && uid != 0 && uid != parent.Uid && uid != st.Uid {
+		report("%s is owned by another user in sticky directory %s", path, parentDir(path))
+	}
+
+	if info.IsDir() && uint64(st.Dev) != uint64(parent.Dev) {
+		report("%s is a mount point", path)
+	}
+}
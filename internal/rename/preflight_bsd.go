@@ -0,0 +1,33 @@
+//go:build darwin || freebsd || openbsd
+
+package rename
+
+import (
+	"os"
+	"syscall"
+)
+
+// File flags from sys/stat.h
+const (
+	userImmutableFlag = 0x00000002
+	userAppendFlag    = 0x00000004
+	sysImmutableFlag  = 0x00020000
+	sysAppendFlag     = 0x00040000
+)
+
+// fileFlags reports whether path has the user or system immutable or
+// append-only flag (chflags uchg, uappnd, schg, sappnd)
+func fileFlags(path string, info os.FileInfo) (immutable, appendOnly bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, false
+	}
+	flags := uint32(st.Flags)
+	return flags&(userImmutableFlag|sysImmutableFlag) != 0, flags&(userAppendFlag|sysAppendFlag) != 0
+}
+
+// nameMax returns the longest file name, in bytes, allowed in dir. The BSDs
+// all use MAXNAMLEN.
+func nameMax(dir string) int {
+	return 255
+}
@@ -0,0 +1,60 @@
+package rename
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Inode flags from linux/fs.h
+const (
+	fsImmutableFlag = 0x10
+	fsAppendFlag    = 0x20
+)
+
+// fsGetFlagsReq returns the FS_IOC_GETFLAGS ioctl request, _IOR('f', 1, long)
+func fsGetFlagsReq() uintptr {
+	read := uintptr(2) << 30
+	switch runtime.GOARCH {
+	case "mips", "mipsle", "mips64", "mips64le", "ppc64", "ppc64le":
+		read = 2 << 29
+	}
+	return read | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+}
+
+// fileFlags reports whether a regular file or directory has the immutable
+// or append-only attribute (chattr +i, +a). Other file types, and files
+// that cannot be opened, report neither.
+func fileFlags(path string, info os.FileInfo) (immutable, appendOnly bool) {
+	flags := syscall.O_RDONLY | syscall.O_NONBLOCK | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	switch {
+	case info.IsDir():
+		flags |= syscall.O_DIRECTORY
+	case !info.Mode().IsRegular():
+		return false, false
+	}
+
+	fd, err := syscall.Open(path, flags, 0)
+	if err != nil {
+		return false, false
+	}
+	defer syscall.Close(fd)
+
+	var attrs int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fsGetFlagsReq(), uintptr(unsafe.Pointer(&attrs)))
+	if errno != 0 {
+		return false, false
+	}
+	return attrs&fsImmutableFlag != 0, attrs&fsAppendFlag != 0
+}
+
+// nameMax returns the longest file name, in bytes, allowed in dir, as
+// reported by statfs(2), or 255 if it cannot be read
+func nameMax(dir string) int {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil || st.Namelen <= 0 {
+		return 255
+	}
+	return int(st.Namelen)
+}
@@ -0,0 +1,219 @@
+package rename
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SessionMaxAge is how long an unfinished session is kept before it is pruned
+const SessionMaxAge = 7 * 24 * time.Hour
+
+// Session is the on-disk state of a gmv run: the working directory, the
+// files being renamed and the editor buffer. It is kept until the run
+// succeeds so that an interrupted edit can be resumed.
+type Session struct {
+	Dir   string
+	Cwd   string
+	Files []string
+
+	// EditLinks is set for a session that edits symlink targets
+	EditLinks bool
+	// EditAttrs is set for a session that edits file attributes
+	EditAttrs bool
+}
+
+// StateDir returns gmv's state directory, creating it if needed. It is
+// $XDG_STATE_HOME/gmv or ~/.local/state/gmv, falling back to the temp dir.
+func StateDir() (string, error) {
+	base := os.Getenv("XDG_STATE_HOME")
+	if base == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			base = filepath.Join(home, ".local", "state")
+		}
+	}
+
+	dir := filepath.Join(base, "gmv")
+	if base == "" || os.MkdirAll(dir, 0700) != nil {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("gmv-state-%d", os.Getuid()))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", fmt.Errorf("failed to create state directory: %w", err)
+		}
+	}
+
+	return dir, nil
+}
+
+// sessionKey identifies a set of files in a working directory
+func sessionKey(cwd string, files []string) string {
+	sum := sha256.Sum256([]byte(cwd + "\x00" + strings.Join(files, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewSession starts a session for files, replacing any earlier session for
+// the same file set
+func NewSession(files []string) (*Session, error) {
+	stateDir, err := StateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	s := &Session{
+		Dir: filepath.Join(stateDir, "sessions", sessionKey(cwd, files)),
+		Cwd: cwd,
+	}
+	if err := os.RemoveAll(s.Dir); err != nil {
+		return nil, fmt.Errorf("failed to reset session: %w", err)
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.Dir, "cwd"), []byte(cwd+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write session: %w", err)
+	}
+	if err := s.SetFiles(files); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// LatestSession returns the most recently used unfinished session
+func LatestSession() (*Session, error) {
+	stateDir, err := StateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(stateDir, "sessions"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	var latest string
+	var latestTime time.Time
+	for _, entry := range entries {
+		dir := filepath.Join(stateDir, "sessions", entry.Name())
+		info, err := os.Stat(filepath.Join(dir, "files"))
+		if err != nil {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest, latestTime = dir, info.ModTime()
+		}
+	}
+	if latest == "" {
+		return nil, fmt.Errorf("no unfinished session to resume")
+	}
+
+	return loadSession(latest)
+}
+
+func loadSession(dir string) (*Session, error) {
+	cwd, err := os.ReadFile(filepath.Join(dir, "cwd"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	files, err := ParseEdited(filepath.Join(dir, "files"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	sess := &Session{Dir: dir, Cwd: strings.TrimSpace(string(cwd)), Files: files}
+	_, err = os.Stat(filepath.Join(dir, "links"))
+	sess.EditLinks = err == nil
+	_, err = os.Stat(filepath.Join(dir, "attrs"))
+	sess.EditAttrs = err == nil
+	return sess, nil
+}
+
+// SetEditLinks records that the session edits symlink targets, so that a
+// resumed session reads its buffer the same way
+func (s *Session) SetEditLinks() error {
+	if err := os.WriteFile(filepath.Join(s.Dir, "links"), nil, 0600); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	s.EditLinks = true
+	return nil
+}
+
+// SetEditAttrs records that the session edits file attributes, so that a
+// resumed session reads its buffer the same way
+func (s *Session) SetEditAttrs() error {
+	if err := os.WriteFile(filepath.Join(s.Dir, "attrs"), nil, 0600); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	s.EditAttrs = true
+	return nil
+}
+
+// BufferPath returns the path of the session's editor buffer
+func (s *Session) BufferPath() string {
+	return filepath.Join(s.Dir, "buffer")
+}
+
+// Buffer returns the saved editor buffer, or the file list if nothing has
+// been edited yet
+func (s *Session) Buffer() ([]string, error) {
+	if !s.Edited() {
+		return s.Files, nil
+	}
+	return ParseEdited(s.BufferPath())
+}
+
+// Edited reports whether the session has a saved editor buffer, which
+// holds the lines as they were in the editor, markers included
+func (s *Session) Edited() bool {
+	_, err := os.Stat(s.BufferPath())
+	return err == nil
+}
+
+// SetFiles records the current names of the files being renamed and drops
+// the buffer, which was based on the previous names
+func (s *Session) SetFiles(files []string) error {
+	if err := WriteBuffer(filepath.Join(s.Dir, "files"), files); err != nil {
+		return err
+	}
+	if err := os.Remove(s.BufferPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to reset buffer: %w", err)
+	}
+	s.Files = files
+	return nil
+}
+
+// Remove deletes the session once it has finished
+func (s *Session) Remove() error {
+	return os.RemoveAll(s.Dir)
+}
+
+// PruneSessions removes unfinished sessions that have not been touched for
+// longer than maxAge
+func PruneSessions(maxAge time.Duration) {
+	stateDir, err := StateDir()
+	if err != nil {
+		return
+	}
+
+	sessions := filepath.Join(stateDir, "sessions")
+	entries, err := os.ReadDir(sessions)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > maxAge {
+			os.RemoveAll(filepath.Join(sessions, entry.Name()))
+		}
+	}
+}
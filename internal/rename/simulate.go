@@ -0,0 +1,192 @@
+package rename
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// fsModel is an in-memory model of the directory entries a plan touches.
+// Each entry is identified by the path it had before the plan ran; paths
+// the model has not seen yet are looked up on disk. Paths are keyed by
+// foldPath, so names differing only in case are one entry where the
+// filesystem ignores case.
+type fsModel struct {
+	entries map[string]string // folded path -> identity, "" if the path is free
+}
+
+func newModel() *fsModel {
+	return &fsModel{entries: make(map[string]string)}
+}
+
+// lookup returns the identity of the entry at path, if there is one. Only
+// a path that does not exist is free; any other error, such as a directory
+// that cannot be searched, is returned, as the model cannot tell.
+func (m *fsModel) lookup(path string) (string, bool, error) {
+	key := foldPath(path)
+	if id, ok := m.entries[key]; ok {
+		return id, id != "", nil
+	}
+	switch _, err := lstatPath(path); err {
+	case nil:
+		m.entries[key] = path
+		return path, true, nil
+	case syscall.ENOENT, syscall.ENOTDIR:
+		m.entries[key] = ""
+		return "", false, nil
+	default:
+		return "", false, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+}
+
+// apply replays one operation, failing where the real one would fail or
+// would replace an entry without the user's agreement
+func (m *fsModel) apply(op RenameOp) error {
+	from, ok, err := m.lookup(op.From)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s no longer exists", op.From)
+	}
+
+	// A relinked symlink, or a file with new attributes, keeps its name
+	if op.Kind == OpRelink || op.Kind == OpAttrs {
+		return nil
+	}
+
+	if op.Kind == OpExchange {
+		to, ok, err := m.lookup(op.To)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s no longer exists", op.To)
+		}
+		m.entries[foldPath(op.From)], m.entries[foldPath(op.To)] = to, from
+		return nil
+	}
+
+	_, exists, err := m.lookup(op.To)
+	if err != nil {
+		return err
+	}
+	if exists && !op.Overwrite {
+		return fmt.Errorf("%s already exists", op.To)
+	}
+	m.entries[foldPath(op.From)] = ""
+	m.entries[foldPath(op.To)] = from
+	return nil
+}
+
+// VerifyPlan checks that plan can run against the files currently on disk:
+// every source exists when its turn comes and no target is overwritten
+// unless the operation allows it
+func VerifyPlan(plan []RenameOp) error {
+	sources := make([]string, len(plan))
+	for i, op := range plan {
+		sources[i] = op.From
+	}
+	detectCaseFolding(sources)
+	m := newModel()
+	for _, op := range plan {
+		if err := m.apply(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SimulatePlan replays plan in memory and checks that it turns original
+// into edited: every file ends up at its edited name, nothing is replaced
+// unless the overwrite was confirmed, and no temp file is left behind. It
+// is run before every real execution, so that a planner bug can never
+// reach the disk.
+func SimulatePlan(original, edited []string, plan []RenameOp) error {
+	detectCaseFolding(original)
+	m := newModel()
+	for i, op := range plan {
+		if err := m.apply(op); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, op, err)
+		}
+	}
+
+	named := make(map[string]bool)
+	for i := range original {
+		named[foldPath(original[i])] = true
+		named[foldPath(edited[i])] = true
+		id, _, err := m.lookup(edited[i])
+		if err != nil {
+			return err
+		}
+		if foldPath(id) != foldPath(original[i]) || id == "" {
+			if id == "" {
+				return fmt.Errorf("%s would not end up at %s, which would be empty", original[i], edited[i])
+			}
+			return fmt.Errorf("%s would end up holding %s instead of %s", edited[i], id, original[i])
+		}
+	}
+
+	var left []string
+	for path, id := range m.entries {
+		if id != "" && !named[path] && strings.HasPrefix(filepath.Base(path), TempPrefix) {
+			left = append(left, path)
+		}
+	}
+	if len(left) > 0 {
+		sort.Strings(left)
+		return fmt.Errorf("temp file %s would be left behind", left[0])
+	}
+
+	return nil
+}
+
+// SimulateReplay simulates a plan that was not made from an edit, such as
+// an undo or a recovery, against the net effect of its own operations:
+// each entry it moves must end up where the plan leaves it, with nothing
+// replaced on the way unless the operation allows it, and none left at a
+// temp name
+func SimulateReplay(plan []RenameOp) error {
+	// Follow each entry from where it starts to where the plan leaves it
+	start := make(map[string]string) // current path -> path it started at
+	var order []string
+	origin := func(path string) string {
+		if from, ok := start[path]; ok {
+			return from
+		}
+		order = append(order, path)
+		return path
+	}
+	for _, op := range plan {
+		from := origin(op.From)
+		switch op.Kind {
+		case OpRelink, OpAttrs:
+			start[op.From] = from
+		case OpExchange:
+			to := origin(op.To)
+			start[op.From], start[op.To] = to, from
+		default:
+			delete(start, op.From)
+			start[op.To] = from
+		}
+	}
+
+	end := make(map[string]string) // starting path -> final path
+	for path, from := range start {
+		end[from] = path
+	}
+	var original, edited []string
+	for _, from := range order {
+		if path, ok := end[from]; ok {
+			if path != from && strings.HasPrefix(filepath.Base(path), TempPrefix) {
+				return fmt.Errorf("temp file %s would be left behind", path)
+			}
+			original = append(original, from)
+			edited = append(edited, path)
+		}
+	}
+	return SimulatePlan(original, edited, plan)
+}
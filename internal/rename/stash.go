@@ -0,0 +1,182 @@
+package rename
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StashPrefix starts the name of a stash directory created next to the
+// files it holds, used when the state directory is on another filesystem
+const StashPrefix = ".gmv_stash_"
+
+// DefaultStashDays is how long stashed files are kept unless GMV_STASH_DAYS
+// says otherwise
+const DefaultStashDays = 30
+
+// stashIndex lists, inside a session's stash, the stash directories that
+// had to be created next to their files
+const stashIndex = "dirs"
+
+var stashCounter atomic.Uint64
+
+// StashRetention returns how long stashed files are kept, from
+// GMV_STASH_DAYS. Zero means overwritten files are not stashed at all.
+func StashRetention() (time.Duration, error) {
+	days := DefaultStashDays
+	if value := os.Getenv("GMV_STASH_DAYS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return DefaultStashDays * 24 * time.Hour, fmt.Errorf("invalid GMV_STASH_DAYS %q", value)
+		}
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// stashRoot returns the directory holding the stashes of all sessions
+func stashRoot() (string, error) {
+	stateDir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "stash"), nil
+}
+
+// AddStash inserts, before each operation that overwrites one of
+// overwrites, a hop that moves the existing target into this session's
+// stash. The stash is in the state directory when that is on the same
+// filesystem as the target, and in a hidden directory beside it otherwise,
+// so the hop is always a rename and never a copy.
+func AddStash(plan []RenameOp, overwrites []string) ([]RenameOp, error) {
+	root, err := stashRoot()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create stash directory: %w", err)
+	}
+	rootDev, err := deviceOf(root)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]bool)
+	for _, file := range overwrites {
+		targets[file] = true
+	}
+
+	group := nextGroup(plan)
+	var result []RenameOp
+	for _, op := range plan {
+		if op.Kind == OpRename && targets[op.To] {
+			dir := filepath.Join(root, SessionID)
+			if dev, err := deviceOf(parentDir(op.To)); err != nil {
+				return nil, err
+			} else if dev != rootDev {
+				dir = filepath.Join(parentDir(op.To), StashPrefix+SessionID)
+			}
+
+			result = append(result, RenameOp{From: op.To, To: stashName(dir, op.To), Kind: OpStash, Group: group})
+			op.Overwrite = false
+			op.Group = group
+			group++
+		}
+		result = append(result, op)
+	}
+
+	return result, nil
+}
+
+// stashName returns an unused path in the stash dir for path
+func stashName(dir, path string) string {
+	for {
+		name := filepath.Join(dir, fmt.Sprintf("%d-%s", stashCounter.Add(1), filepath.Base(filepath.Clean(path))))
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+func deviceOf(dir string) (uint64, error) {
+	st, err := statDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat directory %s: %w", dir, err)
+	}
+	return uint64(st.Dev), nil
+}
+
+// createStashDirs creates the stash directories that plan moves files
+// into, and records those outside the state directory so they are pruned
+// with the session's stash
+func createStashDirs(plan []RenameOp) error {
+	root, err := stashRoot()
+	if err != nil {
+		return err
+	}
+	local := filepath.Join(root, SessionID)
+
+	for _, op := range plan {
+		dir := parentDir(op.To)
+		if op.Kind != OpStash || dir != local && filepath.Base(dir) != StashPrefix+SessionID {
+			continue
+		}
+		if _, err := os.Lstat(dir); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(local, 0700); err != nil {
+			return fmt.Errorf("failed to create stash directory: %w", err)
+		}
+		if dir != local {
+			if err := os.Mkdir(dir, 0700); err != nil {
+				return fmt.Errorf("failed to create stash directory: %w", err)
+			}
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(filepath.Join(local, stashIndex), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return fmt.Errorf("failed to record stash directory: %w", err)
+			}
+			fmt.Fprintln(f, abs)
+			f.Close()
+		}
+	}
+	return nil
+}
+
+// PruneStashes removes the stashes of sessions older than maxAge
+func PruneStashes(maxAge time.Duration) {
+	root, err := stashRoot()
+	if err != nil {
+		return
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= maxAge {
+			continue
+		}
+
+		dir := filepath.Join(root, entry.Name())
+		if index, err := os.ReadFile(filepath.Join(dir, stashIndex)); err == nil {
+			for _, remote := range strings.Split(strings.TrimSpace(string(index)), "\n") {
+				if filepath.Base(remote) == StashPrefix+entry.Name() {
+					os.RemoveAll(remote)
+				}
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,144 @@
+package rename
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// renameat2Trap returns the renameat2 syscall number, which the syscall
+// package does not define for every architecture, or 0 if unknown
+func renameat2Trap() uintptr {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 316
+	case "386":
+		return 353
+	case "arm":
+		return 382
+	case "arm64", "riscv64", "loong64":
+		return 276
+	case "ppc64", "ppc64le":
+		return 357
+	case "s390x":
+		return 347
+	case "mips", "mipsle":
+		return 4351
+	case "mips64", "mips64le":
+		return 5311
+	}
+	return 0
+}
+
+func renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uintptr) error {
+	trap := renameat2Trap()
+	if trap == 0 {
+		return errNotSupported
+	}
+
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall6(trap, uintptr(olddirfd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(newdirfd), uintptr(unsafe.Pointer(newp)), flags, 0)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOSYS, syscall.EINVAL, syscall.EOPNOTSUPP:
+		// Old kernel, or a filesystem without support for the flag
+		return errNotSupported
+	}
+	return errno
+}
+
+// readlinkAt reads the symlink name in dir
+func readlinkAt(dir *dirHandle, name string) (string, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall6(syscall.SYS_READLINKAT, uintptr(dir.fd), uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(size), 0, 0)
+		if errno != 0 {
+			return "", errno
+		}
+		if int(n) < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// symlinkAt creates the symlink name in dir, pointing at target
+func symlinkAt(target string, dir *dirHandle, name string) error {
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(dir.fd), uintptr(unsafe.Pointer(p)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// unlinkAt removes the file name from dir
+func unlinkAt(dir *dirHandle, name string) error {
+	return syscall.Unlinkat(dir.fd, name)
+}
+
+// fstatatTrap returns the syscall number of fstatat for architectures
+// whose Stat_t is the kernel's own layout, or 0 if unknown
+func fstatatTrap() uintptr {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 262 // newfstatat
+	case "386":
+		return 300 // fstatat64
+	case "arm":
+		return 327 // fstatat64
+	case "arm64", "riscv64":
+		return 79
+	case "ppc64", "ppc64le":
+		return 291 // newfstatat
+	case "s390x":
+		return 293 // newfstatat
+	}
+	return 0
+}
+
+const atSymlinkNofollow = 0x100
+
+// lstatAt stats the entry name in dir without following a symlink
+func lstatAt(dir *dirHandle, name string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	trap := fstatatTrap()
+	if trap == 0 {
+		if err := syscall.Lstat(dir.path+"/"+name, &st); err != nil {
+			return nil, err
+		}
+		return &st, nil
+	}
+
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	_, _, errno := syscall.Syscall6(trap, uintptr(dir.fd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&st)), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &st, nil
+}
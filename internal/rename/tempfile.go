@@ -11,16 +11,67 @@ func CreateTempFile(files []string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to create temp file: %w", err)
 	}
-	defer tmpFile.Close()
+	tmpFile.Close()
 
-	// Write each file path on its own line
+	if err := WriteBuffer(tmpFile.Name(), files); err != nil {
+		return "", err
+	}
+
+	return tmpFile.Name(), nil
+}
+
+// WriteBuffer writes an editor buffer with each file path on its own line
+func WriteBuffer(path string, files []string) error {
+	var b strings.Builder
 	for _, file := range files {
-		if _, err := tmpFile.WriteString(file + "\n"); err != nil {
-			return "", fmt.Errorf("failed to write file path: %w", err)
+		b.WriteString(file + "\n")
+	}
+
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write file path: %w", err)
+	}
+
+	return nil
+}
+
+// MarkTypes returns names, the editor lines for files, with a trailing '/'
+// on each directory and a trailing '@' on each symlink, as ls -F shows
+// them, so that both stand out in the buffer
+func MarkTypes(files, names []string) []string {
+	if len(files) != len(names) {
+		return names
+	}
+
+	marked := make([]string, len(names))
+	for i, name := range names {
+		marked[i] = name
+		info, err := os.Lstat(files[i])
+		switch {
+		case err != nil:
+		case info.Mode()&os.ModeSymlink != 0:
+			marked[i] = name + "@"
+		case info.IsDir() && !strings.HasSuffix(name, "/"):
+			marked[i] = name + "/"
 		}
 	}
+	return marked
+}
 
-	return tmpFile.Name(), nil
+// UnmarkLinks removes the '@' that MarkTypes added to the lines of
+// symlinks. A link whose new name ends in '@' needs a second one.
+func UnmarkLinks(files, names []string) []string {
+	if len(files) != len(names) {
+		return names
+	}
+
+	unmarked := make([]string, len(names))
+	for i, name := range names {
+		unmarked[i] = name
+		if info, err := os.Lstat(files[i]); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			unmarked[i] = strings.TrimSuffix(name, "@")
+		}
+	}
+	return unmarked
 }
 
 func ParseEdited(filepath string) ([]string, error) {
@@ -1,7 +1,117 @@
 package rename
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kind of operation in a rename plan
+type OpKind int
+
+const (
+	OpRename   OpKind = iota // move From to To
+	OpExchange               // atomically swap From and To
+	OpBackup                 // move a file about to be overwritten to its backup name
+	OpStash                  // move a file about to be overwritten into the stash
+	OpRelink                 // point the symlink From (and To) at Target instead of OldTarget
+	OpAttrs                  // change the mode, owner or time of From (and To) from OldAttrs to Attrs
+)
+
 // Represents a single rename operation
 type RenameOp struct {
 	From string
 	To   string
+	Kind OpKind
+
+	// Overwrite is set once the user has agreed to replace an existing To.
+	// Without it, renames never replace an existing file.
+	Overwrite bool
+
+	// Operations sharing a non-zero Group, such as the steps of a cycle,
+	// take effect together: if one fails, the others are rolled back
+	Group int
+
+	// Contents of the symlink changed by an OpRelink
+	OldTarget string
+	Target    string
+
+	// Attributes changed by an OpAttrs
+	OldAttrs Attrs
+	Attrs    Attrs
+}
+
+// nextGroup returns a group number not used in plan
+func nextGroup(plan []RenameOp) int {
+	group := 0
+	for _, op := range plan {
+		group = max(group, op.Group)
+	}
+	return group + 1
+}
+
+func (op RenameOp) String() string {
+	switch op.Kind {
+	case OpExchange:
+		return fmt.Sprintf("%s <-> %s", quotePath(op.From), quotePath(op.To))
+	case OpBackup:
+		return fmt.Sprintf("backup: %s -> %s", quotePath(op.From), quotePath(op.To))
+	case OpStash:
+		return fmt.Sprintf("stash: %s -> %s", quotePath(op.From), quotePath(op.To))
+	case OpRelink:
+		return fmt.Sprintf("relink: %s: %s -> %s", quotePath(op.From), quotePath(op.OldTarget), quotePath(op.Target))
+	case OpAttrs:
+		return fmt.Sprintf("attrs: %s: %s -> %s", quotePath(op.From), op.OldAttrs, op.Attrs)
+	}
+	return fmt.Sprintf("%s -> %s", quotePath(op.From), quotePath(op.To))
+}
+
+// quotePath formats a path for the log. A path that could be read as part
+// of the entry around it, such as "stash: a", "backup: a", "a -> b" or
+// "a <-> b", or as a comment, is quoted as a Go string, and so is one with unprintable
+// characters.
+func quotePath(path string) string {
+	if path == "" || strings.TrimSpace(path) != path || strings.HasPrefix(path, "#") ||
+		strings.HasPrefix(path, `"`) || strings.Contains(path, ": ") || strings.Contains(path, " -> ") || strings.Contains(path, " <-> ") ||
+		strings.IndexFunc(path, func(r rune) bool { return !strconv.IsPrint(r) }) >= 0 {
+		return strconv.Quote(path)
+	}
+	return path
+}
+
+// cutPath splits a log entry around the first sep after its first path,
+// which may be quoted
+func cutPath(s, sep string) (path, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		return strings.Cut(s, sep)
+	}
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", false
+	}
+	if rest, ok = strings.CutPrefix(s[len(quoted):], sep); !ok {
+		return "", "", false
+	}
+	path, _ = strconv.Unquote(quoted)
+	return path, rest, true
+}
+
+// unquotePath reads the last path of a log entry, which may be quoted
+func unquotePath(s string) string {
+	if path, err := strconv.Unquote(s); err == nil && strings.HasPrefix(s, `"`) {
+		return path
+	}
+	return s
+}
+
+// reverse returns the operation that undoes op
+func (op RenameOp) reverse() RenameOp {
+	return RenameOp{From: op.To, To: op.From, Kind: op.Kind, Group: op.Group, OldTarget: op.Target, Target: op.OldTarget,
+		OldAttrs: op.Attrs, Attrs: op.OldAttrs}
+}
+
+// Describes a problem with one line of an edit buffer
+type LineConflict struct {
+	Message   string
+	Overwrite bool // a warning only: the target exists outside the list
 }
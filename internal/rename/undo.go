@@ -0,0 +1,153 @@
+package rename
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FindLatestLog returns the most recently written gmv log
+func FindLatestLog() (string, error) {
+	logs, err := filepath.Glob(filepath.Join(os.TempDir(), "gmv-log-*"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list logs: %w", err)
+	}
+
+	type logInfo struct {
+		path  string
+		mtime int64
+	}
+	var found []logInfo
+	for _, path := range logs {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			found = append(found, logInfo{path, info.ModTime().UnixNano()})
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no gmv log found in %s", os.TempDir())
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].mtime != found[j].mtime {
+			return found[i].mtime < found[j].mtime
+		}
+		return found[i].path < found[j].path
+	})
+
+	return found[len(found)-1].path, nil
+}
+
+// ReadLog parses the rename operations recorded in a log, in the order they
+// were performed. Relative paths are resolved against the working directory
+// recorded in the log header.
+func ReadLog(logPath string) ([]RenameOp, error) {
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log: %w", err)
+	}
+
+	cwd := ""
+	resolve := func(path string) string {
+		if cwd == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(cwd, path)
+	}
+
+	var plan []RenameOp
+	group, inGroup := 0, 0 // the group of the next inGroup operations
+	for n, line := range strings.Split(string(content), "\n") {
+		if dir, ok := strings.CutPrefix(line, "# Working directory: "); ok && filepath.IsAbs(dir) {
+			cwd = dir
+		}
+		if size, ok := strings.CutPrefix(line, groupComment); ok {
+			if inGroup, err = strconv.Atoi(size); err != nil {
+				return nil, fmt.Errorf("malformed log entry on line %d: %s", n+1, line)
+			}
+			group++
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		opGroup := 0
+		if inGroup > 0 {
+			inGroup--
+			opGroup = group
+		}
+
+		if rest, ok := strings.CutPrefix(line, "relink: "); ok {
+			link, targets, ok := cutPath(rest, ": ")
+			oldTarget, target, ok2 := cutPath(targets, " -> ")
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("malformed log entry on line %d: %s", n+1, line)
+			}
+			link = resolve(link)
+			plan = append(plan, RenameOp{From: link, To: link, Kind: OpRelink, Group: opGroup, OldTarget: oldTarget, Target: unquotePath(target)})
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(line, "attrs: "); ok {
+			var path, columns string
+			if strings.HasPrefix(rest, `"`) {
+				path, columns, ok = cutPath(rest, ": ")
+			} else if sep := strings.LastIndex(rest, ": "); sep >= 0 {
+				// Attributes never contain ": ", but the unquoted path of
+				// an older log might
+				path, columns = rest[:sep], rest[sep+2:]
+			} else {
+				ok = false
+			}
+			if !ok {
+				return nil, fmt.Errorf("malformed log entry on line %d: %s", n+1, line)
+			}
+			before, after, _ := strings.Cut(columns, " -> ")
+			oldAttrs, err := parseAttrs(before)
+			if err != nil {
+				return nil, fmt.Errorf("malformed log entry on line %d: %w", n+1, err)
+			}
+			attrs, err := parseAttrs(after)
+			if err != nil {
+				return nil, fmt.Errorf("malformed log entry on line %d: %w", n+1, err)
+			}
+			path = resolve(path)
+			plan = append(plan, RenameOp{From: path, To: path, Kind: OpAttrs, Group: opGroup, OldAttrs: oldAttrs, Attrs: attrs})
+			continue
+		}
+
+		kind := OpRename
+		if rest, ok := strings.CutPrefix(line, "backup: "); ok {
+			kind, line = OpBackup, rest
+		} else if rest, ok := strings.CutPrefix(line, "stash: "); ok {
+			kind, line = OpStash, rest
+		}
+
+		// An exchange has no marker, only its separator. A rename whose
+		// quoted target contains that separator has " -> " before it,
+		// which an unquoted path never contains.
+		if a, b, ok := cutPath(line, " <-> "); ok && (strings.HasPrefix(line, `"`) || !strings.Contains(a, " -> ")) {
+			plan = append(plan, RenameOp{From: resolve(a), To: resolve(unquotePath(b)), Kind: OpExchange, Group: opGroup})
+			continue
+		}
+
+		from, to, ok := cutPath(line, " -> ")
+		if !ok {
+			return nil, fmt.Errorf("malformed log entry on line %d: %s", n+1, line)
+		}
+		plan = append(plan, RenameOp{From: resolve(from), To: resolve(unquotePath(to)), Kind: kind, Group: opGroup})
+	}
+
+	return plan, nil
+}
+
+// UndoPlan returns the operations that revert plan: each rename reversed,
+// in reverse order. An exchange is its own inverse.
+func UndoPlan(plan []RenameOp) []RenameOp {
+	undo := make([]RenameOp, 0, len(plan))
+	for i := len(plan) - 1; i >= 0; i-- {
+		undo = append(undo, plan[i].reverse())
+	}
+	return undo
+}
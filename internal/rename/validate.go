@@ -5,20 +5,21 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 )
 
 func ValidateFiles(files []string) error {
 	seen := make(map[string]bool)
 
 	for _, file := range files {
-		// Check for duplicates
-		if seen[file] {
+		// Check for duplicates, counting ./a and a as the same file
+		if seen[filepath.Clean(file)] {
 			return fmt.Errorf("duplicate file specified: %s", file)
 		}
-		seen[file] = true
+		seen[filepath.Clean(file)] = true
 
 		// Check if file exists
-		if _, err := os.Stat(file); os.IsNotExist(err) {
+		if _, err := os.Lstat(file); os.IsNotExist(err) {
 			return fmt.Errorf("file does not exist: %s", file)
 		}
 	}
@@ -32,50 +33,213 @@ func ValidateEdits(original, edited []string) error {
 		return fmt.Errorf("line count mismatch: expected %d lines, got %d lines", len(original), len(edited))
 	}
 
-	// Track target filenames to detect duplicates
+	// Track target filenames to detect duplicates, ignoring case where the
+	// filesystem does
+	detectCaseFolding(original)
 	targets := make(map[string]bool)
 
 	for i := 0; i < len(original); i++ {
-		origPath := original[i]
-		editPath := edited[i]
+		if err := validateEdit(original[i], edited[i]); err != nil {
+			return err
+		}
 
-		// Check that directory hasn't changed
-		origDir := filepath.Dir(origPath)
-		editDir := filepath.Dir(editPath)
+		// Check for duplicate target filenames
+		target := foldPath(filepath.Clean(edited[i]))
+		if targets[target] {
+			return fmt.Errorf("duplicate target filename: %s", edited[i])
+		}
+		targets[target] = true
+	}
 
-		if origDir != editDir {
-			return fmt.Errorf("cannot move files to different directories: %s -> %s", origPath, editPath)
+	// An existing file outside the list can be overwritten, but not by a
+	// directory, and a directory cannot be replaced at all
+	originals := make(map[string]bool)
+	for _, file := range original {
+		originals[foldPath(filepath.Clean(file))] = true
+	}
+	for i := range original {
+		target := filepath.Clean(edited[i])
+		if originals[foldPath(target)] {
+			continue
+		}
+		if err := typeConflict(original[i], target); err != nil {
+			return err
 		}
+	}
 
-		// Check for duplicate target filenames
-		if targets[editPath] {
-			return fmt.Errorf("duplicate target filename: %s", editPath)
+	return nil
+}
+
+// validateEdit checks a single edited line against its original path
+func validateEdit(origPath, editPath string) error {
+	// Check the new name itself before cleaning hides "." and ".."
+	name := strings.TrimRight(editPath, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	switch {
+	case strings.TrimSpace(editPath) == "":
+		return fmt.Errorf("empty filename for %s", origPath)
+	case name == "." || name == "..":
+		return fmt.Errorf("%q is not a valid file name: %s", name, editPath)
+	case strings.ContainsRune(editPath, 0):
+		return fmt.Errorf("file name contains a NUL byte: %q", editPath)
+	case strings.IndexFunc(editPath, unicode.IsControl) >= 0:
+		return fmt.Errorf("file name contains a control character: %q", editPath)
+	}
+
+	// A trailing '/' marks a directory
+	if strings.HasSuffix(editPath, "/") {
+		if info, err := os.Lstat(origPath); err == nil && !info.IsDir() {
+			return fmt.Errorf("%s is not a directory, remove the trailing '/' from %s", origPath, editPath)
+		}
+	}
+
+	// Check that directory hasn't changed
+	origDir := filepath.Dir(filepath.Clean(origPath))
+	editDir := filepath.Dir(filepath.Clean(editPath))
+
+	if origDir != editDir {
+		if within(editDir, origDir) {
+			return fmt.Errorf("file names cannot contain '/': %s", editPath)
 		}
-		targets[editPath] = true
+		return fmt.Errorf("cannot move files to different directories: %s -> %s", origPath, editPath)
+	}
+
+	name = filepath.Base(filepath.Clean(editPath))
+	if limit := nameMax(origDir); len(name) > limit {
+		return fmt.Errorf("file name is %d bytes long, the filesystem allows %d: %s", len(name), limit, editPath)
+	}
+
+	return nil
+}
+
+// typeConflict reports an error if renaming source onto the existing entry
+// at target would replace a file with a directory or the other way round
+func typeConflict(source, target string) error {
+	from, err := os.Lstat(source)
+	if err != nil {
+		return nil
+	}
+	to, err := os.Lstat(target)
+	if err != nil {
+		return nil
 	}
 
+	switch {
+	case from.IsDir() && !to.IsDir():
+		return fmt.Errorf("cannot rename directory %s onto file %s", source, target)
+	case !from.IsDir() && to.IsDir():
+		return fmt.Errorf("cannot rename file %s onto directory %s", source, target)
+	}
 	return nil
 }
 
+// within reports whether dir lies below parent, so that a name edited into
+// dir must have had a '/' typed into it
+func within(dir, parent string) bool {
+	switch parent {
+	case ".":
+		return !filepath.IsAbs(dir) && dir != ".." && !strings.HasPrefix(dir, "../")
+	case "/":
+		return strings.HasPrefix(dir, "/")
+	}
+	return strings.HasPrefix(dir, parent+"/")
+}
+
+// CleanPaths returns paths in the form filepath.Clean gives them, so that
+// ./a and a, or dir/ and dir, name the same file. Empty paths stay empty.
+func CleanPaths(paths []string) []string {
+	cleaned := make([]string, len(paths))
+	for i, path := range paths {
+		if path != "" {
+			cleaned[i] = filepath.Clean(path)
+		}
+	}
+	return cleaned
+}
+
+// Conflicts reports, line by line, why an in-progress edit would be rejected
+// or would overwrite an existing file. Lines without problems are left zero.
+func Conflicts(original, edited []string) []LineConflict {
+	detectCaseFolding(original)
+	originals := make(map[string]bool)
+	for _, file := range original {
+		originals[foldPath(filepath.Clean(file))] = true
+	}
+
+	targets := make(map[string]int)
+	for _, file := range edited {
+		targets[foldPath(filepath.Clean(file))]++
+	}
+
+	conflicts := make([]LineConflict, len(edited))
+	for i, editPath := range edited {
+		switch {
+		case i >= len(original):
+			conflicts[i].Message = "no original file for this line"
+		case strings.TrimSpace(editPath) == "":
+			conflicts[i].Message = "empty filename"
+		case targets[foldPath(filepath.Clean(editPath))] > 1:
+			conflicts[i].Message = fmt.Sprintf("duplicate target filename: %s", editPath)
+		default:
+			target := filepath.Clean(editPath)
+			if err := validateEdit(original[i], editPath); err != nil {
+				conflicts[i].Message = err.Error()
+			} else if originals[foldPath(target)] {
+				break
+			} else if err := typeConflict(original[i], target); err != nil {
+				conflicts[i].Message = err.Error()
+			} else if _, err := os.Lstat(target); err == nil {
+				conflicts[i].Message = fmt.Sprintf("will overwrite %s", editPath)
+				conflicts[i].Overwrite = true
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// lineConflicts is Conflicts for buffer lines that hold more than a name.
+// parse extracts the name from the line for files[i]; a line it cannot
+// parse reports why, and counts as unchanged for the other lines.
+func lineConflicts(files, lines []string, parse func(i int, line string) (string, error)) []LineConflict {
+	names := make([]string, len(lines))
+	errs := make([]error, len(lines))
+	for i, line := range lines {
+		names[i] = line
+		if i < len(files) {
+			if names[i], errs[i] = parse(i, line); errs[i] != nil {
+				names[i] = files[i]
+			}
+		}
+	}
+
+	conflicts := Conflicts(files, names)
+	for i, err := range errs {
+		if err != nil {
+			conflicts[i] = LineConflict{Message: err.Error()}
+		}
+	}
+	return conflicts
+}
+
 func CheckOverwrites(plan []RenameOp, originalFiles []string) []string {
-	// Create a set of original files for quick lookup
+	// Create a set of original files for quick lookup. A target differing
+	// only in case from an original is that original's entry where the
+	// filesystem ignores case.
+	detectCaseFolding(originalFiles)
 	originals := make(map[string]bool)
 	for _, file := range originalFiles {
-		originals[file] = true
+		originals[foldPath(file)] = true
 	}
 
 	var overwrites []string
 
+	// Temp files in the plan are chosen not to exist, so they never show
+	// up here; a leftover temp file with a clashing name would be reported
 	for _, op := range plan {
-		// Skip temp files (used for swaps)
-		baseName := filepath.Base(op.To)
-		if strings.HasPrefix(baseName, ".gmv_temp_") {
-			continue
-		}
-
 		// Check if target exists and is NOT in the original list
-		if _, err := os.Stat(op.To); err == nil {
-			if !originals[op.To] {
+		if _, err := os.Lstat(op.To); err == nil {
+			if !originals[foldPath(op.To)] {
 				// File exists and is not in our rename list - would be overwritten!
 				overwrites = append(overwrites, op.To)
 			}
@@ -84,3 +248,18 @@ func CheckOverwrites(plan []RenameOp, originalFiles []string) []string {
 
 	return overwrites
 }
+
+// MarkOverwrites allows the operations whose targets the user agreed to
+// overwrite to replace them
+func MarkOverwrites(plan []RenameOp, overwrites []string) {
+	allowed := make(map[string]bool)
+	for _, file := range overwrites {
+		allowed[file] = true
+	}
+
+	for i := range plan {
+		if plan[i].Kind == OpRename && allowed[plan[i].To] {
+			plan[i].Overwrite = true
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package tui
+
+import "unicode"
+
+// Segment is a run of text in a word diff
+type Segment struct {
+	Text    string
+	Changed bool
+}
+
+// WordDiff compares two names word by word and returns, for each side, the
+// segments with the words that differ marked as changed. Words are runs of
+// letters and digits; every other character is a word of its own.
+func WordDiff(from, to string) (before, after []Segment) {
+	a, b := splitWords(from), splitWords(to)
+
+	// Longest common subsequence of words
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			before = appendSegment(before, a[i], false)
+			after = appendSegment(after, b[j], false)
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			after = appendSegment(after, b[j], true)
+			j++
+		default:
+			before = appendSegment(before, a[i], true)
+			i++
+		}
+	}
+
+	return before, after
+}
+
+// appendSegment adds text, merging it into the last segment when both have
+// the same state
+func appendSegment(segments []Segment, text string, changed bool) []Segment {
+	if n := len(segments); n > 0 && segments[n-1].Changed == changed {
+		segments[n-1].Text += text
+		return segments
+	}
+	return append(segments, Segment{Text: text, Changed: changed})
+}
+
+func splitWords(s string) []string {
+	var words []string
+	start := -1
+	for i, r := range s {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			words = append(words, s[start:i])
+			start = -1
+		}
+		words = append(words, string(r))
+	}
+	if start >= 0 {
+		words = append(words, s[start:])
+	}
+	return words
+}
@@ -0,0 +1,184 @@
+package tui
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+// ReviewAction is the user's decision at the end of a review
+type ReviewAction int
+
+const (
+	ReviewApply ReviewAction = iota // apply the accepted renames
+	ReviewEdit                      // re-open the editor
+)
+
+const reviewHelp = "Space toggle  a all  n none  e edit  Enter apply  q quit"
+
+// Review shows every changed line as a word-level diff and lets the user
+// accept or reject each rename. It returns the chosen action and the edited
+// names with rejected lines reset to their originals, or ErrCancelled.
+func Review(original, edited []string) (ReviewAction, []string, error) {
+	var rows []int
+	for i := range original {
+		if original[i] != edited[i] {
+			rows = append(rows, i)
+		}
+	}
+
+	accepted := make(map[int]bool)
+	for _, i := range rows {
+		accepted[i] = true
+	}
+
+	subset := func() []string {
+		result := make([]string, len(edited))
+		for i := range edited {
+			result[i] = original[i]
+			if accepted[i] {
+				result[i] = edited[i]
+			}
+		}
+		return result
+	}
+
+	if len(rows) == 0 {
+		return ReviewApply, subset(), nil
+	}
+
+	term, err := openTerminal()
+	if err != nil {
+		return ReviewApply, nil, err
+	}
+	defer term.close()
+
+	cursor, top := 0, 0
+	message := ""
+	for {
+		conflicts := rename.Conflicts(original, subset())
+		top = renderReview(term, original, edited, rows, accepted, conflicts, cursor, top, message)
+		message = ""
+
+		key, err := term.readKey()
+		if err != nil {
+			return ReviewApply, nil, err
+		}
+
+		switch key {
+		case 'q', ctrl('q'), ctrl('c'), keyEscape:
+			return ReviewApply, nil, ErrCancelled
+		case 'e':
+			return ReviewEdit, nil, nil
+		case keyEnter, 'y':
+			if n := countErrors(conflicts); n > 0 {
+				message = fmt.Sprintf("%d conflict(s): a rejected rename is still needed by an accepted one", n)
+				continue
+			}
+			return ReviewApply, subset(), nil
+		case ' ', 'x':
+			accepted[rows[cursor]] = !accepted[rows[cursor]]
+		case 'a', 'n':
+			for _, i := range rows {
+				accepted[i] = key == 'a'
+			}
+		case keyUp, 'k':
+			cursor = max(cursor-1, 0)
+		case keyDown, 'j':
+			cursor = min(cursor+1, len(rows)-1)
+		case keyPageUp:
+			_, height := term.size()
+			cursor = max(cursor-(height-2), 0)
+		case keyPageDown:
+			_, height := term.size()
+			cursor = min(cursor+(height-2), len(rows)-1)
+		}
+	}
+}
+
+func countErrors(conflicts []rename.LineConflict) int {
+	n := 0
+	for _, c := range conflicts {
+		if c.Message != "" && !c.Overwrite {
+			n++
+		}
+	}
+	return n
+}
+
+// renderReview draws the review screen and returns the new scroll offset
+func renderReview(term *terminal, original, edited []string, rows []int, accepted map[int]bool,
+	conflicts []rename.LineConflict, cursor, top int, message string) int {
+	width, height := term.size()
+	visible := max(height-2, 1)
+	if cursor < top {
+		top = cursor
+	} else if cursor >= top+visible {
+		top = cursor - visible + 1
+	}
+
+	count := 0
+	for _, i := range rows {
+		if accepted[i] {
+			count++
+		}
+	}
+
+	out := term.out
+	out.WriteString("\x1b[H\x1b[2J")
+	header := fmt.Sprintf(" gmv review  %d/%d accepted   %s", count, len(rows), reviewHelp)
+	out.WriteString("\x1b[7m" + pad(header, width) + "\x1b[0m")
+
+	for y := 0; y < visible && top+y < len(rows); y++ {
+		i := rows[top+y]
+		out.WriteString(fmt.Sprintf("\x1b[%d;1H", y+2))
+
+		box := "[ ]"
+		if accepted[i] {
+			box = "[x]"
+		}
+		if top+y == cursor {
+			box = "\x1b[1m" + box + "\x1b[0m"
+		}
+		if conflicts[i].Message != "" && !conflicts[i].Overwrite {
+			box = "\x1b[31m" + box + "\x1b[0m"
+		}
+
+		before, after := WordDiff(filepath.Base(original[i]), filepath.Base(edited[i]))
+		dir := filepath.Dir(original[i])
+		prefix := ""
+		if dir != "." {
+			prefix = "\x1b[2m" + dir + string(filepath.Separator) + "\x1b[0m"
+		}
+		out.WriteString(box + " " + prefix + colorSegments(before, "\x1b[31;9m") +
+			" \x1b[2m->\x1b[0m " + colorSegments(after, "\x1b[32;1m"))
+	}
+
+	status := message
+	if status == "" {
+		if c := conflicts[rows[cursor]]; c.Message != "" {
+			status = c.Message
+		} else {
+			status = original[rows[cursor]] + " -> " + edited[rows[cursor]]
+		}
+	}
+	out.WriteString(fmt.Sprintf("\x1b[%d;1H%s", height, pad(status, width)))
+	out.WriteString(fmt.Sprintf("\x1b[%d;2H", cursor-top+2))
+	out.Flush()
+	return top
+}
+
+// colorSegments renders a word diff with the changed words in color
+func colorSegments(segments []Segment, color string) string {
+	var b strings.Builder
+	for _, s := range segments {
+		if s.Changed {
+			b.WriteString(color + s.Text + "\x1b[0m")
+		} else {
+			b.WriteString(s.Text)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,189 @@
+package tui
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// Special keys are negative so they never collide with runes or control bytes
+const (
+	keyUp rune = -(iota + 1)
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyPageUp
+	keyPageDown
+	keyDelete
+	keyNone // an unrecognised sequence that should be ignored
+)
+
+const (
+	keyTab       rune = '\t'
+	keyEnter     rune = '\r'
+	keyEscape    rune = 0x1b
+	keyBackspace rune = 0x7f
+)
+
+// ctrl returns the byte a terminal sends for Ctrl+c
+func ctrl(c byte) rune {
+	return rune(c & 0x1f)
+}
+
+// terminal is a raw-mode terminal on stdin/stdout
+type terminal struct {
+	fd      int
+	saved   syscall.Termios
+	out     *bufio.Writer
+	pending []byte
+}
+
+type winsize struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// IsTerminal reports whether fd is a terminal
+func IsTerminal(fd int) bool {
+	var termios syscall.Termios
+	return ioctl(fd, ioctlGetTermios, unsafe.Pointer(&termios)) == nil
+}
+
+// openTerminal switches stdin to raw mode and enters the alternate screen
+func openTerminal() (*terminal, error) {
+	t := &terminal{fd: int(os.Stdin.Fd()), out: bufio.NewWriter(os.Stdout)}
+
+	if err := ioctl(t.fd, ioctlGetTermios, unsafe.Pointer(&t.saved)); err != nil {
+		return nil, errors.New("the built-in editor needs an interactive terminal")
+	}
+
+	raw := t.saved
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := ioctl(t.fd, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+
+	t.out.WriteString("\x1b[?1049h")
+	t.out.Flush()
+	active.Store(t)
+	return t, nil
+}
+
+// active is the terminal in raw mode, if any, so that Restore can reset it
+var active atomic.Pointer[terminal]
+
+// close leaves the alternate screen and restores the saved terminal mode
+func (t *terminal) close() {
+	if !active.CompareAndSwap(t, nil) {
+		return
+	}
+	t.out.WriteString("\x1b[?1049l")
+	t.out.Flush()
+	ioctl(t.fd, ioctlSetTermios, unsafe.Pointer(&t.saved))
+}
+
+// Restore leaves the built-in editor's raw mode and alternate screen if it
+// is open. It is for signal handlers that exit while the editor runs.
+func Restore() {
+	if t := active.Swap(nil); t != nil {
+		os.Stdout.WriteString("\x1b[?1049l")
+		ioctl(t.fd, ioctlSetTermios, unsafe.Pointer(&t.saved))
+	}
+}
+
+// size returns the terminal dimensions, defaulting to 80x24
+func (t *terminal) size() (width, height int) {
+	var ws winsize
+	if err := ioctl(t.fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+// readKey returns the next key press, decoding escape sequences and UTF-8
+func (t *terminal) readKey() (rune, error) {
+	for {
+		key, err := t.nextKey()
+		if err != nil || key != keyNone {
+			return key, err
+		}
+	}
+}
+
+func (t *terminal) nextKey() (rune, error) {
+	if len(t.pending) == 0 {
+		buf := make([]byte, 256)
+		n, err := syscall.Read(t.fd, buf)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, errors.New("terminal closed")
+		}
+		t.pending = buf[:n]
+	}
+
+	b := t.pending[0]
+	if b == 0x1b {
+		if key, n := decodeEscape(t.pending); n > 0 {
+			t.pending = t.pending[n:]
+			return key, nil
+		}
+		t.pending = t.pending[1:]
+		return keyEscape, nil
+	}
+
+	r, n := utf8.DecodeRune(t.pending)
+	t.pending = t.pending[n:]
+	if r == '\n' {
+		r = keyEnter
+	}
+	return r, nil
+}
+
+// decodeEscape recognises the cursor and editing keys sent by common terminals
+func decodeEscape(seq []byte) (rune, int) {
+	sequences := map[string]rune{
+		"\x1b[A": keyUp, "\x1b[B": keyDown, "\x1b[C": keyRight, "\x1b[D": keyLeft,
+		"\x1bOA": keyUp, "\x1bOB": keyDown, "\x1bOC": keyRight, "\x1bOD": keyLeft,
+		"\x1b[H": keyHome, "\x1b[F": keyEnd, "\x1bOH": keyHome, "\x1bOF": keyEnd,
+		"\x1b[1~": keyHome, "\x1b[4~": keyEnd, "\x1b[7~": keyHome, "\x1b[8~": keyEnd,
+		"\x1b[3~": keyDelete, "\x1b[5~": keyPageUp, "\x1b[6~": keyPageDown,
+	}
+	for s, key := range sequences {
+		if len(seq) >= len(s) && string(seq[:len(s)]) == s {
+			return key, len(s)
+		}
+	}
+
+	// Swallow any other CSI sequence (modified arrows, function keys) whole
+	if len(seq) > 2 && seq[1] == '[' {
+		for i := 2; i < len(seq); i++ {
+			if seq[i] >= 0x40 && seq[i] <= 0x7e {
+				return keyNone, i + 1
+			}
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,10 @@
+//go:build darwin || freebsd || openbsd
+
+package tui
+
+import "syscall"
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
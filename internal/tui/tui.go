@@ -0,0 +1,398 @@
+// Package tui implements gmv's built-in full-screen rename editor. It is used
+// with --tui, or when no external editor can be found.
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+// ErrCancelled is returned when the user quits without applying
+var ErrCancelled = errors.New("operation cancelled")
+
+const helpLine = "^S apply  ^Q quit  ^F find  ^N next  ^R replace  Tab select  ^A all  ^O revert"
+
+// editor holds the state of one TUI session
+type editor struct {
+	term      *terminal
+	original  []string
+	lines     [][]rune
+	selected  []bool
+	conflicts []rename.LineConflict
+	check     func(edited []string) []rename.LineConflict
+	row, col  int // cursor position in lines
+	top       int // first visible line
+	search    string
+	message   string
+}
+
+// Run lets the user edit current, line by line, in a full-screen editor.
+// original holds the names on disk and is used for the conflict preview and
+// for reverting lines. Lines that hold more than a name are previewed with
+// check instead, if given. It returns the edited names, or ErrCancelled.
+func Run(original, current []string, check func(edited []string) []rename.LineConflict) ([]string, error) {
+	term, err := openTerminal()
+	if err != nil {
+		return nil, err
+	}
+	defer term.close()
+
+	e := &editor{
+		term:     term,
+		original: original,
+		check:    check,
+		lines:    make([][]rune, len(current)),
+		selected: make([]bool, len(current)),
+	}
+	for i, line := range current {
+		e.lines[i] = []rune(line)
+	}
+	e.refresh()
+
+	for {
+		e.render()
+		key, err := term.readKey()
+		if err != nil {
+			return nil, err
+		}
+		e.message = ""
+
+		switch key {
+		case ctrl('q'), ctrl('c'):
+			return nil, ErrCancelled
+		case ctrl('s'):
+			if n := e.errorCount(); n > 0 {
+				e.message = fmt.Sprintf("%d line(s) have conflicts; fix them before applying", n)
+				continue
+			}
+			return e.result(), nil
+		case ctrl('f'):
+			if pattern, ok := e.prompt("Find: ", e.search); ok && pattern != "" {
+				e.search = pattern
+				e.findNext()
+			}
+		case ctrl('n'):
+			e.findNext()
+		case ctrl('r'):
+			e.replace()
+		case ctrl('a'):
+			e.selectAll()
+		case ctrl('o'):
+			e.revert()
+		case keyTab:
+			e.selected[e.row] = !e.selected[e.row]
+			e.moveRow(1)
+		case keyUp:
+			e.moveRow(-1)
+		case keyDown, keyEnter:
+			e.moveRow(1)
+		case keyPageUp:
+			e.moveRow(-e.pageSize())
+		case keyPageDown:
+			e.moveRow(e.pageSize())
+		default:
+			if e.editLine(key) {
+				e.refresh()
+			}
+		}
+	}
+}
+
+// editLine applies a line-editing key to the current line and reports
+// whether the text changed
+func (e *editor) editLine(key rune) bool {
+	line, changed := editRunes(e.lines[e.row], &e.col, key)
+	e.lines[e.row] = line
+	return changed
+}
+
+// editRunes applies a line-editing key to line at *col
+func editRunes(line []rune, col *int, key rune) ([]rune, bool) {
+	switch key {
+	case keyLeft:
+		if *col > 0 {
+			*col--
+		}
+	case keyRight:
+		if *col < len(line) {
+			*col++
+		}
+	case keyHome, ctrl('b'):
+		*col = 0
+	case keyEnd, ctrl('e'):
+		*col = len(line)
+	case keyBackspace, ctrl('h'):
+		if *col > 0 {
+			line = append(line[:*col-1], line[*col:]...)
+			*col--
+			return line, true
+		}
+	case keyDelete:
+		if *col < len(line) {
+			return append(line[:*col], line[*col+1:]...), true
+		}
+	case ctrl('u'):
+		line = line[*col:]
+		*col = 0
+		return line, true
+	case ctrl('k'):
+		return line[:*col], true
+	case ctrl('w'):
+		start := *col
+		for start > 0 && line[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && line[start-1] != ' ' && line[start-1] != '/' {
+			start--
+		}
+		line = append(line[:start], line[*col:]...)
+		*col = start
+		return line, true
+	default:
+		if key >= ' ' && key != keyBackspace {
+			line = append(line[:*col], append([]rune{key}, line[*col:]...)...)
+			*col++
+			return line, true
+		}
+	}
+	return line, false
+}
+
+func (e *editor) result() []string {
+	result := make([]string, len(e.lines))
+	for i, line := range e.lines {
+		result[i] = string(line)
+	}
+	return result
+}
+
+// refresh recomputes the conflict preview after an edit
+func (e *editor) refresh() {
+	if e.check != nil {
+		e.conflicts = e.check(e.result())
+		return
+	}
+	e.conflicts = rename.Conflicts(e.original, e.result())
+}
+
+func (e *editor) errorCount() int {
+	return countErrors(e.conflicts)
+}
+
+func (e *editor) pageSize() int {
+	_, height := e.term.size()
+	return max(height-2, 1)
+}
+
+func (e *editor) moveRow(delta int) {
+	e.row = min(max(e.row+delta, 0), len(e.lines)-1)
+	e.col = min(e.col, len(e.lines[e.row]))
+}
+
+// targets returns the lines affected by a bulk command: the selection, or
+// the whole buffer if nothing is selected
+func (e *editor) targets() []int {
+	var rows, all []int
+	for i := range e.lines {
+		all = append(all, i)
+		if e.selected[i] {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) == 0 {
+		return all
+	}
+	return rows
+}
+
+func (e *editor) hasSelection() bool {
+	for _, s := range e.selected {
+		if s {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *editor) selectAll() {
+	all := true
+	for _, s := range e.selected {
+		all = all && s
+	}
+	for i := range e.selected {
+		e.selected[i] = !all
+	}
+}
+
+// revert restores the original names of the selected lines, or of the
+// current line if nothing is selected
+func (e *editor) revert() {
+	rows := []int{e.row}
+	if e.hasSelection() {
+		rows = e.targets()
+	}
+	for _, i := range rows {
+		e.lines[i] = []rune(e.original[i])
+	}
+	e.col = min(e.col, len(e.lines[e.row]))
+	e.message = fmt.Sprintf("Reverted %d line(s)", len(rows))
+	e.refresh()
+}
+
+func (e *editor) findNext() {
+	if e.search == "" {
+		e.message = "No search pattern"
+		return
+	}
+	for n := 1; n <= len(e.lines); n++ {
+		i := (e.row + n) % len(e.lines)
+		if idx := strings.Index(string(e.lines[i]), e.search); idx >= 0 {
+			e.row = i
+			e.col = len([]rune(string(e.lines[i])[:idx]))
+			return
+		}
+	}
+	e.message = fmt.Sprintf("Not found: %s", e.search)
+}
+
+// replace substitutes text in the selected lines, or in every line if
+// nothing is selected
+func (e *editor) replace() {
+	from, ok := e.prompt("Replace: ", e.search)
+	if !ok || from == "" {
+		return
+	}
+	to, ok := e.prompt(fmt.Sprintf("Replace %q with: ", from), "")
+	if !ok {
+		return
+	}
+
+	count := 0
+	for _, i := range e.targets() {
+		line := string(e.lines[i])
+		if strings.Contains(line, from) {
+			e.lines[i] = []rune(strings.ReplaceAll(line, from, to))
+			count++
+		}
+	}
+	e.search = from
+	e.col = min(e.col, len(e.lines[e.row]))
+	e.message = fmt.Sprintf("Replaced in %d line(s)", count)
+	e.refresh()
+}
+
+// prompt reads a line of input on the status bar
+func (e *editor) prompt(label, initial string) (string, bool) {
+	input := []rune(initial)
+	col := len(input)
+	for {
+		width, height := e.term.size()
+		e.term.out.WriteString(fmt.Sprintf("\x1b[%d;1H\x1b[2K", height))
+		text, offset := window(input, col, width-len(label)-1)
+		e.term.out.WriteString(label + text)
+		e.term.out.WriteString(fmt.Sprintf("\x1b[%d;%dH", height, len(label)+col-offset+1))
+		e.term.out.Flush()
+
+		key, err := e.term.readKey()
+		if err != nil {
+			return "", false
+		}
+		switch key {
+		case keyEnter:
+			return string(input), true
+		case keyEscape, ctrl('c'), ctrl('q'):
+			return "", false
+		default:
+			input, _ = editRunes(input, &col, key)
+		}
+	}
+}
+
+// render redraws the whole screen
+func (e *editor) render() {
+	width, height := e.term.size()
+	visible := max(height-2, 1)
+	if e.row < e.top {
+		e.top = e.row
+	} else if e.row >= e.top+visible {
+		e.top = e.row - visible + 1
+	}
+
+	out := e.term.out
+	out.WriteString("\x1b[H\x1b[2J")
+
+	changed := 0
+	for i, line := range e.lines {
+		if string(line) != e.original[i] {
+			changed++
+		}
+	}
+	header := fmt.Sprintf(" gmv  %d/%d changed  %d conflict(s)   %s", changed, len(e.lines), e.errorCount(), helpLine)
+	out.WriteString("\x1b[7m" + pad(header, width) + "\x1b[0m")
+
+	cursorX := 1
+	for y := 0; y < visible && e.top+y < len(e.lines); y++ {
+		i := e.top + y
+		out.WriteString(fmt.Sprintf("\x1b[%d;1H", y+2))
+
+		mark := " "
+		if e.selected[i] {
+			mark = "*"
+		}
+		status, color := " ", ""
+		switch {
+		case e.conflicts[i].Overwrite:
+			status, color = "?", "\x1b[33m"
+		case e.conflicts[i].Message != "":
+			status, color = "!", "\x1b[31m"
+		case string(e.lines[i]) != e.original[i]:
+			status, color = "~", "\x1b[32m"
+		}
+
+		col := 0
+		if i == e.row {
+			col = e.col
+		}
+		text, offset := window(e.lines[i], col, width-4)
+		out.WriteString(mark + color + status + "\x1b[0m " + color + text + "\x1b[0m")
+		if i == e.row {
+			cursorX = 4 + e.col - offset
+		}
+	}
+
+	status := e.message
+	if status == "" && len(e.lines) > 0 {
+		if c := e.conflicts[e.row]; c.Message != "" {
+			status = c.Message
+		} else if string(e.lines[e.row]) != e.original[e.row] {
+			status = "was: " + e.original[e.row]
+		}
+	}
+	out.WriteString(fmt.Sprintf("\x1b[%d;1H%s", height, pad(status, width)))
+	out.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.row-e.top+2, cursorX))
+	out.Flush()
+}
+
+// window returns the part of line that fits in width columns while keeping
+// col visible, and the offset of the first rune shown
+func window(line []rune, col, width int) (string, int) {
+	width = max(width, 1)
+	offset := 0
+	if col >= width {
+		offset = col - width + 1
+	}
+	end := min(len(line), offset+width)
+	return string(line[offset:end]), offset
+}
+
+// pad truncates or pads s to exactly width columns
+func pad(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/ishrq/gmv/internal/rename"
+	"github.com/ishrq/gmv/internal/tui"
 )
 
 func printHelp() {
@@ -14,10 +22,35 @@ func printHelp() {
 
 	USAGE:
 	gmv [OPTIONS] <files>...
+	gmv [OPTIONS] --resume
+	gmv undo [--dry-run] [logfile]
+	gmv doctor [--dry-run] [dirs]...
 
 	OPTIONS:
 	--dry-run    Print changes without applying them
 	--force, -f  Skip confirmation prompt for overwrites
+	--backup[=POLICY], -b
+	             Keep each overwritten file as name~ (simple), name.~N~
+	             (numbered), or numbered only if such backups exist
+	             (existing, the default)
+	--tui        Edit names in the built-in full-screen editor
+	--review     Review a diff of the renames and pick which to apply
+	--keep-going, -k
+	             Continue past failed renames, skipping those that depend
+	             on them, and print a summary (exit status 2)
+	--fix-links DIR
+	             Also update the symlinks under DIR that point at a
+	             renamed file
+	--edit-links Edit the targets of symlinks, listed as link -> target
+	--attrs      Edit the mode, owner and modification time of each file,
+	             listed as columns before its name
+	--check-busy Warn about files that running processes hold open
+	--skip-busy  Leave files that are in use unrenamed
+	--interactive, -i
+	             Confirm each rename individually
+	--loop       After applying, re-open the editor on the new names
+	             until the buffer is saved unchanged
+	--resume     Re-open the last unfinished session with its edits
 	--help, -h   Show this help message
 
 	EXAMPLES:
@@ -29,46 +62,166 @@ func printHelp() {
 	gmv */*                 # Rename all files in all directories
 	gmv --dry-run *         # Preview changes without applying
 	gmv --force *           # Skip overwrite confirmation
+	gmv -b *                # Back up files before overwriting them
+	gmv --fix-links . lib/* # Keep links to the renamed libraries working
+	gmv --edit-links data/* # Retarget the symlinks in data
+	gmv --attrs *.sh        # Change permissions, owners and times
+	gmv --tui *             # Rename in the built-in editor
+	gmv --review *          # Accept or reject each rename before applying
+	gmv -i *                # Confirm each rename (y/n/a/q)
+	gmv --loop *            # Rename in several rounds
+	gmv --resume            # Continue an edit that failed validation
+	gmv undo                # Revert the latest rename session
+	gmv doctor              # Restore temp files left by a crashed run
 	gmv --help              # Print help
 
 	DESCRIPTION:
 	gmv opens your $EDITOR with a list of files to rename. Edit the filenames,
 	save and exit. The files will be renamed accordingly. File swaps are
-	automatically handled using temporary files.
+	exchanged atomically where supported, and cycles are handled using
+	temporary files. A rename never replaces a file you did not agree to
+	overwrite, even one created while gmv was running.
+
+	If no editor is available, or --tui is given, gmv uses its built-in
+	full-screen editor instead.
 
 	A log of all rename operations is saved in your system's temp directory.
+	gmv undo reverts the renames in the latest log, or in the given log.
+	gmv doctor finds .gmv_temp_* files left by an interrupted run, in the
+	given directories (default: the current one) and in those recorded in
+	unfinished journals, and restores them to their intended names.
 	`
 	fmt.Print(help)
 }
 
-func parseArgs() (files []string, dryRun bool, force bool, err error) {
+type options struct {
+	files       []string
+	dryRun      bool
+	force       bool
+	keepGoing   bool
+	checkBusy   bool
+	skipBusy    bool
+	backup      rename.BackupPolicy
+	fixLinks    string
+	editLinks   bool
+	attrs       bool
+	tui         bool
+	review      bool
+	interactive bool
+	loop        bool
+	resume      bool
+	undo        bool
+	undoLog     string
+	doctor      bool
+}
+
+func parseArgs() (opts options, err error) {
 	args := os.Args[1:]
 
-	for _, arg := range args {
+	if len(args) > 0 && args[0] == "undo" {
+		opts.undo = true
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "doctor" {
+		opts.doctor = true
+		args = args[1:]
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
 		switch arg {
 		case "--help", "-h":
 			printHelp()
 			os.Exit(0)
 		case "--dry-run":
-			dryRun = true
+			opts.dryRun = true
 		case "--force", "-f":
-			force = true
+			opts.force = true
+		case "--keep-going", "-k":
+			opts.keepGoing = true
+		case "--check-busy":
+			opts.checkBusy = true
+		case "--skip-busy":
+			opts.checkBusy = true
+			opts.skipBusy = true
+		case "--backup", "-b":
+			opts.backup = rename.BackupExisting
+		case "--fix-links":
+			if i+1 == len(args) {
+				return opts, fmt.Errorf("--fix-links needs a directory")
+			}
+			i++
+			opts.fixLinks = args[i]
+		case "--edit-links":
+			opts.editLinks = true
+		case "--attrs":
+			opts.attrs = true
+		case "--tui":
+			opts.tui = true
+		case "--review":
+			opts.review = true
+		case "--interactive", "-i":
+			opts.interactive = true
+		case "--loop":
+			opts.loop = true
+		case "--resume":
+			opts.resume = true
 		default:
-			files = append(files, arg)
+			if root, ok := strings.CutPrefix(arg, "--fix-links="); ok {
+				opts.fixLinks = root
+				continue
+			}
+			if policy, ok := strings.CutPrefix(arg, "--backup="); ok {
+				if opts.backup, err = rename.ParseBackupPolicy(policy); err != nil {
+					return opts, err
+				}
+				continue
+			}
+			opts.files = append(opts.files, arg)
 		}
 	}
 
-	if len(files) == 0 {
-		return nil, false, false, fmt.Errorf("no files specified")
+	if opts.doctor {
+		return opts, nil
+	}
+
+	if opts.undo {
+		if len(opts.files) > 1 {
+			return opts, fmt.Errorf("undo takes at most one log file")
+		}
+		if len(opts.files) == 1 {
+			opts.undoLog = opts.files[0]
+		}
+		return opts, nil
 	}
 
-	return files, dryRun, force, nil
+	if opts.editLinks && opts.attrs {
+		return opts, fmt.Errorf("--edit-links cannot be combined with --attrs")
+	}
+
+	if opts.loop && opts.dryRun {
+		return opts, fmt.Errorf("--loop cannot be combined with --dry-run")
+	}
+
+	if opts.resume {
+		if len(opts.files) > 0 {
+			return opts, fmt.Errorf("--resume does not take files")
+		}
+		return opts, nil
+	}
+
+	if len(opts.files) == 0 {
+		return opts, fmt.Errorf("no files specified")
+	}
+
+	return opts, nil
 }
 
+// stdin is shared by all prompts so buffered input is not lost between them
+var stdin = bufio.NewReader(os.Stdin)
+
 func promptUser(message string) bool {
-	reader := bufio.NewReader(os.Stdin)
 	fmt.Printf("%s (y/N): ", message)
-	response, err := reader.ReadString('\n')
+	response, err := stdin.ReadString('\n')
 	if err != nil {
 		return false
 	}
@@ -76,83 +229,1042 @@ func promptUser(message string) bool {
 	return response == "y" || response == "yes"
 }
 
-func main() {
-	files, dryRun, force, err := parseArgs()
+// confirmEach asks about every rename in turn, like mv -i. Answers are y(es),
+// n(o), a(ll remaining) and q(uit, skipping the rest). Skipping a rename also
+// skips the renames that depend on it.
+func confirmEach(original, edited []string) []string {
+	skip := make(map[int]bool)
+	accepted := make(map[int]bool)
+	acceptAll := false
+
+	for i := range original {
+		if original[i] == edited[i] || skip[i] {
+			continue
+		}
+
+		answer := "y"
+		if !acceptAll {
+			fmt.Printf("rename %s -> %s? (y/n/a/q): ", original[i], edited[i])
+			response, err := stdin.ReadString('\n')
+			if err != nil {
+				response = "q"
+			}
+			answer = strings.TrimSpace(strings.ToLower(response))
+		}
+
+		switch answer {
+		case "y", "yes":
+			accepted[i] = true
+		case "a", "all":
+			accepted[i] = true
+			acceptAll = true
+		case "q", "quit":
+			for j := i; j < len(original); j++ {
+				if !accepted[j] {
+					skip[j] = true
+				}
+			}
+		default:
+			skip[i] = true
+		}
+
+		if !skip[i] && answer != "q" && answer != "quit" {
+			continue
+		}
+
+		_, cascaded := rename.SkipRenames(original, edited, skip)
+		for _, j := range cascaded {
+			if skip[j] {
+				continue
+			}
+			skip[j] = true
+			if accepted[j] {
+				fmt.Printf("  %s -> %s can no longer be applied and will be skipped\n", original[j], edited[j])
+				delete(accepted, j)
+			} else if j > i {
+				fmt.Printf("  skipping %s -> %s (depends on a skipped rename)\n", original[j], edited[j])
+			}
+		}
+		if answer == "q" || answer == "quit" {
+			break
+		}
+	}
+
+	result, _ := rename.SkipRenames(original, edited, skip)
+	return result
+}
+
+// editNames lets the user edit current in $EDITOR, or in the built-in
+// editor when requested or when no editor is available. Directories and
+// symlinks are marked in the buffer, and the link markers are removed from
+// the result. The edits are kept in the session buffer so they survive a
+// failed validation or a crash. check, if given, previews the conflicts of
+// lines that hold more than a name in the built-in editor.
+func editNames(original, current []string, useTUI bool, sess *rename.Session, check func([]string) []rename.LineConflict) ([]string, error) {
+	current = rename.MarkTypes(original, current)
+	if !useTUI {
+		if _, err := rename.FindEditor(); err == nil {
+			if err := rename.WriteBuffer(sess.BufferPath(), current); err != nil {
+				return nil, err
+			}
+
+			editing.Store(true)
+			err := rename.LaunchEditor(sess.BufferPath())
+			editing.Store(false)
+			if err != nil {
+				return nil, err
+			}
+
+			edited, err := rename.ParseEdited(sess.BufferPath())
+			if err != nil {
+				return nil, err
+			}
+			return rename.UnmarkLinks(original, edited), nil
+		}
+	}
+
+	// The built-in editor works line by line on the original list
+	marked := rename.MarkTypes(original, original)
+	if len(current) != len(original) {
+		current = marked
+	}
+
+	edited, err := tui.Run(marked, current, check)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return nil, err
+	}
+	return rename.UnmarkLinks(original, edited), rename.WriteBuffer(sess.BufferPath(), edited)
+}
+
+// checkBusy warns about renamed files that running processes hold open
+// and, with skip set, drops those renames and the ones that depend on them
+func checkBusy(original, edited []string, skip bool) []string {
+	var sources []string
+	index := make(map[string]int)
+	for i := range original {
+		if original[i] != edited[i] {
+			sources = append(sources, original[i])
+			index[original[i]] = i
+		}
 	}
 
-	if err := rename.ValidateFiles(files); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	busy := rename.FindBusy(sources)
+	if len(busy) == 0 {
+		return edited
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: The following files are in use:\n")
+	skipped := make(map[int]bool)
+	for _, b := range busy {
+		fmt.Fprintf(os.Stderr, "  - %s (pid %d, %s)\n", b.Path, b.PID, b.Command)
+		skipped[index[b.Path]] = true
+	}
+	if !skip {
+		return edited
+	}
+
+	result, cascaded := rename.SkipRenames(original, edited, skipped)
+	fmt.Fprintf(os.Stderr, "Skipping %d busy file(s).\n", len(skipped))
+	for _, j := range cascaded {
+		if !skipped[j] {
+			fmt.Fprintf(os.Stderr, "  skipping %s -> %s (depends on a busy file)\n", original[j], edited[j])
+		}
+	}
+	return result
+}
+
+// progressWidth is the width of the progress bar in columns
+const progressWidth = 30
+
+// progress renders execution events. On a terminal it draws a progress bar
+// with the rate and estimated time left; otherwise it prints a line per
+// operation. In dry-run mode it lists the planned operations.
+type progress struct {
+	dryRun   bool
+	tty      bool
+	total    int
+	finished int
+	start    time.Time
+	drawn    time.Time
+}
+
+func newProgress(dryRun bool) *progress {
+	return &progress{dryRun: dryRun, tty: tui.IsTerminal(int(os.Stderr.Fd()))}
+}
+
+func (p *progress) Observe(e rename.Event) {
+	switch e.Kind {
+	case rename.EventPlanned:
+		if p.dryRun {
+			fmt.Println(e.Op)
+		}
+		p.total++
+		return
+	case rename.EventStarted:
+		if p.start.IsZero() {
+			p.start = time.Now()
+		}
+		return
+	}
+
+	if p.tty {
+		// Failures are kept on screen above the bar
+		if e.Kind == rename.EventFailed {
+			fmt.Fprintf(os.Stderr, "\r\x1b[K%v\n", e.Err)
+		}
+	} else {
+		switch e.Kind {
+		case rename.EventDone:
+			switch e.Op.Kind {
+			case rename.OpRelink:
+				fmt.Printf("relinked %s -> %s\n", e.Op.From, e.Op.Target)
+			case rename.OpAttrs:
+				fmt.Printf("changed %s to %s\n", e.Op.From, e.Op.Attrs)
+			default:
+				fmt.Printf("renamed %s\n", e.Op)
+			}
+		case rename.EventFailed:
+			fmt.Printf("%v\n", e.Err)
+		case rename.EventSkipped:
+			fmt.Printf("skipped %s\n", e.Op)
+		case rename.EventRolledBack:
+			fmt.Printf("rolled back %s\n", e.Op)
+		}
+	}
+
+	if e.Kind != rename.EventRolledBack && !(e.Kind == rename.EventFailed && e.Err.Rollback) {
+		p.finished++
+	}
+	p.draw(false)
+}
+
+// draw redraws the progress bar, at most ten times a second unless final
+func (p *progress) draw(final bool) {
+	if !p.tty || p.total == 0 {
+		return
+	}
+	now := time.Now()
+	if !final && now.Sub(p.drawn) < 100*time.Millisecond {
+		return
 	}
+	p.drawn = now
 
-	tempFilePath, err := rename.CreateTempFile(files)
+	filled := progressWidth * p.finished / p.total
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressWidth-filled)
+
+	rate, eta := 0.0, "--:--"
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 && p.finished > 0 {
+		rate = float64(p.finished) / elapsed
+		left := time.Duration(float64(p.total-p.finished) / rate * float64(time.Second))
+		eta = formatETA(left)
+	}
+
+	fmt.Fprintf(os.Stderr, "\r[%s] %d/%d  %.0f/s  ETA %s\x1b[K", bar, p.finished, p.total, rate, eta)
+}
+
+// finish draws the final state of the bar and ends its line
+func (p *progress) finish() {
+	if p.tty && p.finished > 0 {
+		p.draw(true)
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// formatETA formats a duration as m:ss, or h:mm:ss when over an hour
+func formatETA(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// runner holds the state shared by the rename rounds of one invocation
+type runner struct {
+	opts  options
+	sess  *rename.Session
+	dirs  rename.DirSnapshot // parent directories as validated
+	locks *rename.DirLocks   // directories held for the session
+	stash bool               // move overwritten files into the stash
+}
+
+// exitPartial is the exit status when --keep-going finished with some
+// renames failed
+const exitPartial = 2
+
+// log appends the operations of a round to the session's log, creating
+// the log on the first round, and returns its path
+func (r *runner) log(logPath string, round int, plan []rename.RenameOp) (string, error) {
+	heading := ""
+	if r.opts.loop {
+		heading = fmt.Sprintf("Round %d", round)
+	}
+
+	var err error
+	if logPath == "" {
+		logPath, err = rename.CreateLog()
+	}
+	if err == nil {
+		err = rename.AppendLog(logPath, heading, plan)
+	}
+	return logPath, err
+}
+
+// reportFailures logs and summarizes a round in which some operations
+// failed, and returns the exit status
+func (r *runner) reportFailures(e *rename.ExecError, logPath string, round int) int {
+	status := 1
+	switch {
+	case e.Interrupted:
+		status = 128 + int(caught.Load())
+		fmt.Fprintf(os.Stderr, "\nInterrupted: renamed %d, %d not run.\n", len(e.Done), len(e.Pending))
+		if len(e.Failed) > 0 {
+			printSummary(e)
+		}
+	case r.opts.keepGoing:
+		status = exitPartial
+		printSummary(e)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", e)
+	}
+
+	logPath, err := r.log(logPath, round, e.Done)
+	if err == nil {
+		err = rename.AppendFailures(logPath, e)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Warning: failed to write log: %v\n", err)
+		return status
 	}
 
-	if err := rename.LaunchEditor(tempFilePath); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	fmt.Fprintf(os.Stderr, "A log file is saved at %s\n", logPath)
+	if len(e.Done) == 0 {
+		fmt.Fprintf(os.Stderr, "Run gmv --resume to continue editing.\n")
+		return status
+	}
+
+	// The file list no longer matches the disk, so the session cannot be
+	// resumed; the log is the way back
+	r.sess.Remove()
+	fmt.Fprintf(os.Stderr, "Run gmv undo to revert the renames that succeeded.\n")
+	return status
+}
+
+// printSummary lists the failed operations by cause, then those skipped
+// because they depended on a failure and those rolled back
+func printSummary(e *rename.ExecError) {
+	fmt.Fprintf(os.Stderr, "\nRenamed %d, failed %d, skipped %d, rolled back %d.\n",
+		len(e.Done), len(e.Failed), len(e.Skipped), len(e.RolledBack))
+
+	var causes []string
+	byCause := make(map[string][]*rename.OpError)
+	for _, failure := range e.Failed {
+		cause := failureCause(failure)
+		if byCause[cause] == nil {
+			causes = append(causes, cause)
+		}
+		byCause[cause] = append(byCause[cause], failure)
 	}
+	for _, cause := range causes {
+		fmt.Fprintf(os.Stderr, "Failed: %s (%d)\n", cause, len(byCause[cause]))
+		for _, failure := range byCause[cause] {
+			fmt.Fprintf(os.Stderr, "  %s\n", failure.Op)
+		}
+	}
+
+	if len(e.Skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped, depending on a failed rename (%d)\n", len(e.Skipped))
+		for _, op := range e.Skipped {
+			fmt.Fprintf(os.Stderr, "  %s\n", op)
+		}
+	}
+	if len(e.RolledBack) > 0 {
+		fmt.Fprintf(os.Stderr, "Rolled back, part of a failed cycle or backup (%d)\n", len(e.RolledBack))
+		for _, op := range e.RolledBack {
+			fmt.Fprintf(os.Stderr, "  %s\n", op)
+		}
+	}
+}
+
+// failureCause names the category of a failed operation
+func failureCause(failure *rename.OpError) string {
+	var errno syscall.Errno
+	switch {
+	case failure.Rollback:
+		return "rollback failed"
+	case errors.Is(failure.Err, fs.ErrExist):
+		return "target exists"
+	case errors.As(failure.Err, &errno):
+		return errno.Error()
+	}
+	return failure.Err.Error()
+}
 
-	editedFiles, err := rename.ParseEdited(tempFilePath)
+// round runs one edit, validate, plan and execute pass over files, starting
+// the editor on buffer, or on the files if buffer is nil. It returns the names the files have afterwards and
+// the plan that ran.
+func (r *runner) round(files, buffer []string) ([]string, []rename.RenameOp, error) {
+	opts, sess := r.opts, r.sess
+
+	// Fingerprint the files as the editor opens, so that changes made to
+	// them while it is open are caught before anything is renamed
+	sources, err := rename.FingerprintFiles(files)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return nil, nil, err
 	}
 
-	if err := rename.ValidateEdits(files, editedFiles); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	// With --edit-links each line also holds the link's target, and with
+	// --attrs the file's attributes
+	names := files
+	var oldTargets, newTargets []string
+	var oldAttrs, newAttrs []rename.Attrs
+	var check func([]string) []rename.LineConflict
+	switch {
+	case opts.editLinks:
+		if oldTargets, err = rename.ReadLinks(files); err != nil {
+			return nil, nil, err
+		}
+		names = rename.LinkLines(files, oldTargets)
+		check = func(lines []string) []rename.LineConflict { return rename.LinkConflicts(files, lines) }
+	case opts.attrs:
+		if oldAttrs, err = rename.ReadAttrs(files); err != nil {
+			return nil, nil, err
+		}
+		names = rename.AttrLines(files, oldAttrs)
+		check = func(lines []string) []rename.LineConflict { return rename.AttrConflicts(files, oldAttrs, lines) }
+	}
+	if buffer == nil {
+		buffer = names
+	}
+
+	lines := buffer
+	var editedFiles []string
+	for {
+		var err error
+		lines, err = editNames(names, lines, opts.tui, sess, check)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		editedFiles = lines
+		switch {
+		case opts.editLinks:
+			if editedFiles, newTargets, err = rename.SplitLinkLines(lines); err != nil {
+				return nil, nil, err
+			}
+		case opts.attrs:
+			if editedFiles, newAttrs, err = rename.ParseAttrLines(lines, oldAttrs); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if err := rename.ValidateEdits(files, editedFiles); err != nil {
+			return nil, nil, err
+		}
+		editedFiles = rename.CleanPaths(editedFiles)
+
+		if !opts.review {
+			break
+		}
+
+		// Only the accepted renames go on to the planner
+		action, accepted, err := tui.Review(files, editedFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+		if action == tui.ReviewApply {
+			editedFiles = accepted
+			break
+		}
+	}
+
+	if opts.interactive {
+		editedFiles = confirmEach(files, editedFiles)
+	}
+
+	if opts.checkBusy {
+		editedFiles = checkBusy(files, editedFiles, opts.skipBusy)
 	}
 
 	plan, err := rename.BuildRenamePlan(files, editedFiles)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return nil, nil, err
+	}
+	// Edited link targets and attributes are changed before the renames,
+	// while the files still have their current names
+	switch {
+	case opts.editLinks:
+		plan = append(rename.RelinkPlan(files, oldTargets, newTargets), plan...)
+	case opts.attrs:
+		attrsPlan, err := rename.AttrsPlan(files, oldAttrs, newAttrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		plan = append(attrsPlan, plan...)
 	}
 
 	// Check for changes
 	if len(plan) == 0 {
-		fmt.Println("No files were renamed.")
-		os.Exit(0)
+		return files, nil, nil
 	}
 
 	// Check for overwrites
 	overwrites := rename.CheckOverwrites(plan, files)
 
 	if len(overwrites) > 0 {
-		fmt.Fprintf(os.Stderr, "WARNING: The following files will be overwritten:\n")
+		switch {
+		case opts.backup != rename.BackupNone:
+			fmt.Fprintf(os.Stderr, "WARNING: The following files will be overwritten (a backup of each is kept):\n")
+		case r.stash:
+			fmt.Fprintf(os.Stderr, "WARNING: The following files will be overwritten (gmv undo restores them from the stash):\n")
+		default:
+			fmt.Fprintf(os.Stderr, "WARNING: The following files will be overwritten:\n")
+		}
 		for _, file := range overwrites {
 			fmt.Fprintf(os.Stderr, "  - %s\n", file)
 		}
 
-		if dryRun {
+		if opts.dryRun {
 			fmt.Fprintf(os.Stderr, "\n")
-		} else if !force {
+		} else if !opts.force {
 			if !promptUser("Continue with overwrites?") {
-				fmt.Println("Operation cancelled.")
-				os.Exit(0)
+				return nil, nil, tui.ErrCancelled
+			}
+		}
+		switch {
+		case opts.backup != rename.BackupNone:
+			plan, err = rename.AddBackups(plan, overwrites, opts.backup)
+		case r.stash:
+			plan, err = rename.AddStash(plan, overwrites)
+		default:
+			rename.MarkOverwrites(plan, overwrites)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Point the symlinks under --fix-links at the new names. Each is
+	// rewritten just before the renames it depends on, while its own path
+	// still exists, and is rolled back with them if one fails.
+	if opts.fixLinks != "" {
+		plan, err = rename.FixLinks(opts.fixLinks, files, editedFiles, plan)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The relinks and the stash can reach beyond the directories of the
+	// files; those are held too until the plan has run
+	if err := r.locks.Lock(planPaths(plan)); err != nil {
+		return nil, nil, err
+	}
+
+	// Prove on a model that the plan does what was asked before it runs
+	if err := rename.SimulatePlan(files, editedFiles, plan); err != nil {
+		return nil, nil, fmt.Errorf("refusing to run a plan that fails its check, nothing was renamed: %w", err)
+	}
+
+	// Refuse to start a batch that is known to fail part way through. With
+	// --keep-going the blocked renames fail on their own and are skipped.
+	if blockers := rename.Preflight(plan); len(blockers) > 0 {
+		if opts.keepGoing {
+			fmt.Fprintf(os.Stderr, "WARNING: The following renames will fail:\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "Cannot rename:\n")
+		}
+		for _, blocker := range blockers {
+			fmt.Fprintf(os.Stderr, "  - %s\n", blocker)
+		}
+		if !opts.keepGoing {
+			return nil, nil, fmt.Errorf("%d problem(s) found before renaming", len(blockers))
+		}
+	}
+
+	// Journal the plan so gmv doctor can repair an interrupted run
+	if !opts.dryRun {
+		if err := rename.WriteJournal(plan); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	// Signals stay deferred until the caller has logged the round, so an
+	// interrupt cannot leave renames on disk without their log
+	progress := newProgress(opts.dryRun)
+	executing.Store(true)
+	err = rename.Execute(plan, rename.ExecOptions{
+		DryRun:    opts.dryRun,
+		KeepGoing: opts.keepGoing,
+		Dirs:      r.dirs,
+		Sources:   sources,
+		Stop:      stop,
+		Observer:  progress,
+	})
+	progress.finish()
+
+	// Execute never leaves a group half done, so the journal is only
+	// needed while it runs
+	if !opts.dryRun {
+		rename.RemoveJournal(rename.SessionID)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return editedFiles, plan, nil
+}
+
+// describeOps counts what plan does by kind, as in "renamed 3 file(s) and
+// updated 1 link(s)". Moves to and from temp names, backups and stashes
+// are steps of the renames and are not counted.
+func describeOps(plan []rename.RenameOp) string {
+	var renamed, relinked, changed int
+	for _, op := range plan {
+		switch op.Kind {
+		case rename.OpRelink:
+			relinked++
+		case rename.OpAttrs:
+			changed++
+		case rename.OpExchange:
+			renamed += 2
+		case rename.OpRename:
+			if !strings.HasPrefix(filepath.Base(op.To), rename.TempPrefix) {
+				renamed++
+			}
+		}
+	}
+
+	var parts []string
+	if renamed > 0 {
+		parts = append(parts, fmt.Sprintf("renamed %d file(s)", renamed))
+	}
+	if relinked > 0 {
+		parts = append(parts, fmt.Sprintf("updated %d link(s)", relinked))
+	}
+	if changed > 0 {
+		parts = append(parts, fmt.Sprintf("changed the attributes of %d file(s)", changed))
+	}
+	switch len(parts) {
+	case 0:
+		return "changed nothing"
+	case 1:
+		return parts[0]
+	}
+	return strings.Join(parts[:len(parts)-1], ", ") + " and " + parts[len(parts)-1]
+}
+
+// planPaths returns the paths that the operations of plan touch
+func planPaths(plan []rename.RenameOp) []string {
+	var paths []string
+	for _, op := range plan {
+		paths = append(paths, op.From, op.To)
+	}
+	return paths
+}
+
+// lockPlan locks the directories that plan renames in
+func lockPlan(plan []rename.RenameOp) (*rename.DirLocks, error) {
+	return rename.LockDirs(planPaths(plan))
+}
+
+// runUndo reverts every rename recorded in a log, the latest one by default
+func runUndo(opts options) error {
+	logPath := opts.undoLog
+	if logPath == "" {
+		var err error
+		if logPath, err = rename.FindLatestLog(); err != nil {
+			return err
+		}
+	}
+
+	plan, err := rename.ReadLog(logPath)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		fmt.Printf("Nothing to undo in %s\n", logPath)
+		return nil
+	}
+
+	undo := rename.UndoPlan(plan)
+	locks, err := lockPlan(undo)
+	if err != nil {
+		return err
+	}
+	defer locks.Release()
+
+	if err := rename.VerifyPlan(undo); err != nil {
+		return fmt.Errorf("cannot undo %s: %w", logPath, err)
+	}
+	if err := rename.SimulateReplay(undo); err != nil {
+		return fmt.Errorf("refusing to run a plan that fails its check, nothing was renamed: %w", err)
+	}
+
+	undoLog, err := replay(undo, "Undo of "+logPath, opts, true)
+	if err != nil || undoLog == "" {
+		return err
+	}
+
+	fmt.Printf("Reverted %s: %s.\n", logPath, describeOps(undo))
+	fmt.Printf("A log file is saved at %s\n", undoLog)
+	return nil
+}
+
+// replay runs a plan that was not made from an edit, such as an undo or a
+// recovery, the way a round runs its plan: journaled if asked, and with
+// signals deferred until what ran is logged. If the plan stops part way,
+// it reports what ran and exits. It returns the log path, or "" on a dry
+// run or if the log could not be written.
+func replay(plan []rename.RenameOp, heading string, opts options, journal bool) (string, error) {
+	journal = journal && !opts.dryRun
+	if journal {
+		if err := rename.WriteJournal(plan); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	progress := newProgress(opts.dryRun)
+	executing.Store(true)
+	err := rename.Execute(plan, rename.ExecOptions{DryRun: opts.dryRun, Stop: stop, Observer: progress})
+	progress.finish()
+	if journal {
+		rename.RemoveJournal(rename.SessionID)
+	}
+
+	var execErr *rename.ExecError
+	if errors.As(err, &execErr) {
+		exit(reportReplay(execErr, heading))
+	}
+	if err != nil || opts.dryRun {
+		executing.Store(false)
+		return "", err
+	}
+
+	logPath, err := rename.CreateLog()
+	if err == nil {
+		err = rename.AppendLog(logPath, heading, plan)
+	}
+	executing.Store(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write log: %v\n", err)
+		logPath = ""
+	}
+	if signo := caught.Load(); signo != 0 {
+		fmt.Fprintf(os.Stderr, "\nInterrupted after the renames completed.\n")
+		if logPath != "" {
+			fmt.Fprintf(os.Stderr, "A log file is saved at %s\n", logPath)
+		}
+		exit(128 + int(signo))
+	}
+	return logPath, nil
+}
+
+// reportReplay logs and summarizes a replayed plan in which some
+// operations failed, and returns the exit status
+func reportReplay(e *rename.ExecError, heading string) int {
+	status := 1
+	if e.Interrupted {
+		status = 128 + int(caught.Load())
+		fmt.Fprintf(os.Stderr, "\nInterrupted: renamed %d, %d not run.\n", len(e.Done), len(e.Pending))
+		if len(e.Failed) > 0 {
+			printSummary(e)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", e)
+	}
+
+	logPath, err := rename.CreateLog()
+	if err == nil {
+		err = rename.AppendLog(logPath, heading, e.Done)
+	}
+	if err == nil {
+		err = rename.AppendFailures(logPath, e)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write log: %v\n", err)
+		return status
+	}
+
+	fmt.Fprintf(os.Stderr, "A log file is saved at %s\n", logPath)
+	if len(e.Done) > 0 {
+		fmt.Fprintf(os.Stderr, "Run gmv undo to revert the renames that succeeded.\n")
+	}
+	return status
+}
+
+// runDoctor restores the temp files stranded by interrupted runs
+func runDoctor(opts options) error {
+	dirs := opts.files
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+
+	recovery, err := rename.PlanRecovery(dirs)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range recovery.Unresolved {
+		fmt.Fprintf(os.Stderr, "Cannot restore %s\n", problem)
+	}
+	if len(recovery.Plan) == 0 && len(recovery.Unresolved) == 0 {
+		fmt.Println("No stray temp files found.")
+	}
+
+	logPath := ""
+	if len(recovery.Plan) > 0 {
+		// A session that still holds the lock is running, not stranded
+		locks, err := lockPlan(recovery.Plan)
+		if err != nil {
+			return err
+		}
+		if err := rename.SimulateReplay(recovery.Plan); err != nil {
+			locks.Release()
+			return fmt.Errorf("refusing to run a plan that fails its check, nothing was renamed: %w", err)
+		}
+
+		// The journals of the stranded sessions still describe the
+		// recovery, so it needs none of its own
+		logPath, err = replay(recovery.Plan, "Recovered by gmv doctor", opts, false)
+		locks.Release()
+		if err != nil {
+			return err
+		}
+	}
+	if opts.dryRun {
+		return nil
+	}
+
+	recovery.RemoveJournals()
+
+	if len(recovery.Plan) > 0 {
+		fmt.Printf("Restored %d file(s).\n", len(recovery.Plan))
+		if logPath != "" {
+			fmt.Printf("A log file is saved at %s\n", logPath)
+		}
+	}
+
+	if len(recovery.Unresolved) > 0 {
+		return fmt.Errorf("%d temp file(s) could not be restored", len(recovery.Unresolved))
+	}
+	return nil
+}
+
+// Signal handling. While renames run, and until they are logged, SIGINT
+// and SIGTERM only close stop, and the executor finishes the cycle or
+// backup in progress before it returns. While an external editor runs,
+// Ctrl-C is left to the editor. At any other time gmv cleans up and exits
+// straight away.
+var (
+	stop      = make(chan struct{})
+	caught    atomic.Int32 // the first signal received while executing
+	executing atomic.Bool
+	editing   atomic.Bool
+)
+
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			signo := int32(sig.(syscall.Signal))
+			switch {
+			case executing.Load():
+				if caught.CompareAndSwap(0, signo) {
+					close(stop)
+				}
+			case editing.Load() && sig == syscall.SIGINT:
+			default:
+				tui.Restore()
+				fmt.Fprintf(os.Stderr, "\nInterrupted.\n")
+				exit(128 + int(signo))
 			}
 		}
+	}()
+}
+
+// cleanups run before gmv exits, including through exit
+var cleanups []func()
+
+func atExit(cleanup func()) {
+	cleanups = append(cleanups, cleanup)
+}
+
+// exit runs the registered cleanups and exits with status
+func exit(status int) {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
 	}
+	os.Exit(status)
+}
 
-	if err := rename.ExecuteRenames(plan, dryRun); err != nil {
+func main() {
+	opts, err := parseArgs()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	if !dryRun {
-		logPath, err := rename.WriteLog(plan)
+	handleSignals()
+
+	if opts.doctor {
+		if err := runDoctor(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.undo {
+		if err := runUndo(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	rename.PruneSessions(rename.SessionMaxAge)
+
+	retention, err := rename.StashRetention()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if retention > 0 {
+		rename.PruneStashes(retention)
+	}
+
+	var sess *rename.Session
+	if opts.resume {
+		sess, err = rename.LatestSession()
+		if err == nil && sess.Cwd != "" {
+			err = os.Chdir(sess.Cwd)
+		}
+	} else {
+		sess, err = rename.NewSession(rename.CleanPaths(opts.files))
+		if err == nil && opts.editLinks {
+			err = sess.SetEditLinks()
+		}
+		if err == nil && opts.attrs {
+			err = sess.SetEditAttrs()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts.editLinks = sess.EditLinks
+	opts.attrs = sess.EditAttrs
+
+	// Hold the directories from before validation until the last rename,
+	// so that two sessions cannot interleave their renames
+	files := sess.Files
+	locks, err := rename.LockDirs(files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	atExit(locks.Release)
+	defer locks.Release()
+
+	if err := rename.ValidateFiles(files); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if opts.editLinks {
+		if _, err := rename.ReadLinks(files); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --edit-links: %v\n", err)
+			exit(1)
+		}
+	}
+
+	dirs, err := rename.SnapshotDirs(files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	r := &runner{opts: opts, sess: sess, dirs: dirs, locks: locks, stash: retention > 0}
+
+	// A saved buffer is resumed as it was; otherwise each round starts
+	// from the files
+	var buffer []string
+	if sess.Edited() {
+		if buffer, err = sess.Buffer(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		if !opts.editLinks && !opts.attrs {
+			buffer = rename.UnmarkLinks(files, buffer)
+		}
+	}
+	if opts.resume {
+		fmt.Printf("Resuming session in %s\n", sess.Cwd)
+	}
+
+	// With --loop, keep re-opening the editor on the new names until a
+	// round changes nothing. All rounds share one log so that a single undo
+	// reverts the whole session.
+	logPath := ""
+	var done []rename.RenameOp
+	for round := 1; ; round++ {
+		newNames, plan, err := r.round(files, buffer)
+		if errors.Is(err, tui.ErrCancelled) {
+			fmt.Println("Operation cancelled.")
+			if logPath == "" {
+				exit(0)
+			}
+			break
+		}
+		var execErr *rename.ExecError
+		if errors.As(err, &execErr) {
+			exit(r.reportFailures(execErr, logPath, round))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if logPath != "" {
+				fmt.Fprintf(os.Stderr, "Earlier rounds are logged at %s\n", logPath)
+			}
+			fmt.Fprintf(os.Stderr, "Run gmv --resume to continue editing.\n")
+			exit(1)
+		}
+
+		if len(plan) == 0 {
+			sess.Remove()
+			if round == 1 {
+				fmt.Println("No files were renamed.")
+				exit(0)
+			}
+			break
+		}
+
+		if opts.dryRun {
+			sess.Remove()
+			return
+		}
+
+		done = append(done, plan...)
+		logPath, err = r.log(logPath, round, plan)
+		executing.Store(false)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: failed to write log: %v\n", err)
-		} else {
-			fmt.Printf("Successfully renamed files.\n")
-			fmt.Printf("A log file is saved at %s\n", logPath)
+			return
+		}
+		if signo := caught.Load(); signo != 0 {
+			fmt.Fprintf(os.Stderr, "\nInterrupted after the renames completed.\n")
+			fmt.Fprintf(os.Stderr, "A log file is saved at %s\n", logPath)
+			exit(128 + int(signo))
+		}
+
+		if !opts.loop {
+			sess.Remove()
+			break
+		}
+		files, buffer = newNames, nil
+		if err := sess.SetFiles(files); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 		}
 	}
+
+	fmt.Printf("Successfully %s.\n", describeOps(done))
+	fmt.Printf("A log file is saved at %s\n", logPath)
 }
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+func TestEditAttrs(t *testing.T) {
+	files := []string{"a.sh", "b.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	a, b := filepath.Join(tmpDir, "a.sh"), filepath.Join(tmpDir, "b.txt")
+	if err := os.Chmod(a, 0644); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+	before, err := os.Stat(b)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+
+	original := []string{a, b}
+	oldAttrs, err := rename.ReadAttrs(original)
+	if err != nil {
+		t.Fatalf("Read attrs failed: %v", err)
+	}
+	lines := rename.AttrLines(original, oldAttrs)
+	if !strings.HasPrefix(lines[0], "0644 ") || !strings.HasSuffix(lines[0], " "+a) {
+		t.Errorf("Unexpected buffer line %q", lines[0])
+	}
+
+	for _, bad := range []string{"0944" + lines[0][4:], "0644 nosuchuser:x 2026-01-02T10:00 " + a, "0644 " + a} {
+		if _, _, err := rename.ParseAttrLines([]string{bad, lines[1]}, oldAttrs); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+
+	// Change the mode of a.sh and rename it, and set the time of b.txt
+	fields := strings.Fields(lines[1])
+	edited := []string{
+		"0755" + strings.TrimSuffix(lines[0][4:], a) + filepath.Join(tmpDir, "c.sh"),
+		fields[0] + " " + fields[1] + " 2020-01-02T10:00 " + b,
+	}
+	names, newAttrs, err := rename.ParseAttrLines(edited, oldAttrs)
+	if err != nil {
+		t.Fatalf("Parse lines failed: %v", err)
+	}
+
+	attrsPlan, err := rename.AttrsPlan(original, oldAttrs, newAttrs)
+	if err != nil {
+		t.Fatalf("Attrs plan failed: %v", err)
+	}
+	plan, err := rename.BuildRenamePlan(original, names)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	plan = append(attrsPlan, plan...)
+	if len(plan) != 3 || plan[0].Kind != rename.OpAttrs {
+		t.Fatalf("Expected two attribute changes and a rename, got %v", plan)
+	}
+	if err := rename.SimulatePlan(original, names, plan); err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if info, err := os.Stat(names[0]); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("c.sh has mode %v (%v), expected 0755", info.Mode(), err)
+	}
+	want := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	if info, _ := os.Stat(b); !info.ModTime().Equal(want) {
+		t.Errorf("b.txt was modified at %v, expected %v", info.ModTime(), want)
+	}
+
+	// The changes are logged and undone with the renames, to the nanosecond
+	logPath, err := rename.WriteLog(plan)
+	if err != nil {
+		t.Fatalf("Write log failed: %v", err)
+	}
+	logged, err := rename.ReadLog(logPath)
+	if err != nil {
+		t.Fatalf("Read log failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(rename.UndoPlan(logged), false); err != nil {
+		t.Fatalf("Execute undo failed: %v", err)
+	}
+	if info, err := os.Stat(a); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("a.sh has mode %v (%v) after undo, expected 0644", info.Mode(), err)
+	}
+	if info, _ := os.Stat(b); !info.ModTime().Equal(before.ModTime()) {
+		t.Errorf("b.txt was modified at %v after undo, expected %v", info.ModTime(), before.ModTime())
+	}
+
+	// A file whose mode changed since the plan was made is left alone
+	if err := os.Chmod(a, 0600); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+	if err := rename.ExecuteRenames(attrsPlan[:1], false); err == nil {
+		t.Error("Expected a change to a changed file to fail")
+	}
+	if info, _ := os.Stat(a); info.Mode().Perm() != 0600 {
+		t.Errorf("a.sh has mode %v after a refused change", info.Mode())
+	}
+}
+
+func TestAttrConflicts(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"dir/file"})
+	defer cleanup()
+
+	file := filepath.Join(tmpDir, "dir", "file")
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+	files := []string{file}
+	old, err := rename.ReadAttrs(files)
+	if err != nil {
+		t.Fatalf("Read attrs failed: %v", err)
+	}
+	line := rename.AttrLines(files, old)[0]
+
+	// Changing the mode of a file in a subdirectory is not a move
+	conflicts := rename.AttrConflicts(files, old, []string{"0600" + line[4:]})
+	if conflicts[0].Message != "" {
+		t.Errorf("Unexpected conflict for a mode change: %s", conflicts[0].Message)
+	}
+
+	for _, bad := range []string{"0999" + line[4:], strings.TrimSuffix(line, file) + filepath.Join(tmpDir, "file")} {
+		if conflicts := rename.AttrConflicts(files, old, []string{bad}); conflicts[0].Message == "" {
+			t.Errorf("Expected a conflict for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+func TestBackupOverwrittenTarget(t *testing.T) {
+	files := []string{"a.txt", "b.txt", "b.txt~"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+
+	a := filepath.Join(tmpDir, "a.txt")
+	b := filepath.Join(tmpDir, "b.txt")
+	writeContents(t, []string{a, b, b + "~"})
+
+	plan, err := rename.BuildRenamePlan([]string{a}, []string{b})
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	overwrites := rename.CheckOverwrites(plan, []string{a})
+
+	// A simple backup would replace the existing b.txt~
+	if _, err := rename.AddBackups(plan, overwrites, rename.BackupSimple); err == nil {
+		t.Fatal("Expected simple backup to refuse an existing backup file")
+	}
+
+	// existing falls back to simple while no numbered backups exist
+	if _, err := rename.AddBackups(plan, overwrites, rename.BackupExisting); err == nil {
+		t.Fatal("Expected existing backup to behave like simple")
+	}
+
+	if err := os.WriteFile(b+".~3~", []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to create numbered backup: %v", err)
+	}
+	backed, err := rename.AddBackups(plan, overwrites, rename.BackupExisting)
+	if err != nil {
+		t.Fatalf("Add backups failed: %v", err)
+	}
+
+	expected := []rename.RenameOp{
+		{From: b, To: b + ".~4~", Kind: rename.OpBackup, Group: 1},
+		{From: a, To: b, Group: 1},
+	}
+	if len(backed) != len(expected) {
+		t.Fatalf("Expected %d operations, got %d", len(expected), len(backed))
+	}
+	for i, op := range backed {
+		if op != expected[i] {
+			t.Errorf("Operation %d: expected %v, got %v", i, expected[i], op)
+		}
+	}
+
+	if err := rename.ExecuteRenames(backed, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	checkContent(t, b, "a.txt")
+	checkContent(t, b+".~4~", "b.txt")
+	checkContent(t, b+"~", "b.txt~")
+
+	// The backup hop is logged and undone
+	logPath, err := rename.WriteLog(backed)
+	if err != nil {
+		t.Fatalf("Write log failed: %v", err)
+	}
+	logged, err := rename.ReadLog(logPath)
+	if err != nil {
+		t.Fatalf("Read log failed: %v", err)
+	}
+	undo := rename.UndoPlan(logged)
+	if err := rename.VerifyPlan(undo); err != nil {
+		t.Fatalf("Verify undo failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(undo, false); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	checkContent(t, a, "a.txt")
+	checkContent(t, b, "b.txt")
+	if _, err := os.Lstat(b + ".~4~"); !os.IsNotExist(err) {
+		t.Errorf("Expected backup to be restored, got %v", err)
+	}
+}
+
+func TestStashOverwrittenTarget(t *testing.T) {
+	files := []string{"a.txt", "b.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+	t.Setenv("XDG_STATE_HOME", filepath.Join(tmpDir, "state"))
+
+	a := filepath.Join(tmpDir, "a.txt")
+	b := filepath.Join(tmpDir, "b.txt")
+	writeContents(t, []string{a, b})
+
+	plan, err := rename.BuildRenamePlan([]string{a}, []string{b})
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	plan, err = rename.AddStash(plan, rename.CheckOverwrites(plan, []string{a}))
+	if err != nil {
+		t.Fatalf("Add stash failed: %v", err)
+	}
+	if len(plan) != 2 || plan[0].Kind != rename.OpStash || plan[0].From != b {
+		t.Fatalf("Expected b.txt to be stashed first, got %v", plan)
+	}
+	stashed := plan[0].To
+
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	checkContent(t, b, "a.txt")
+	checkContent(t, stashed, "b.txt")
+
+	logPath, err := rename.WriteLog(plan)
+	if err != nil {
+		t.Fatalf("Write log failed: %v", err)
+	}
+	logged, err := rename.ReadLog(logPath)
+	if err != nil {
+		t.Fatalf("Read log failed: %v", err)
+	}
+	undo := rename.UndoPlan(logged)
+	if err := rename.VerifyPlan(undo); err != nil {
+		t.Fatalf("Verify undo failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(undo, false); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	checkContent(t, a, "a.txt")
+	checkContent(t, b, "b.txt")
+
+	// Old stashes are pruned
+	t.Setenv("GMV_STASH_DAYS", "1")
+	retention, err := rename.StashRetention()
+	if err != nil {
+		t.Fatalf("Stash retention failed: %v", err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Dir(stashed), old, old); err != nil {
+		t.Fatalf("Failed to age stash: %v", err)
+	}
+	rename.PruneStashes(retention)
+	if _, err := os.Lstat(filepath.Dir(stashed)); !os.IsNotExist(err) {
+		t.Errorf("Expected old stash to be pruned, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	buildOnce sync.Once
+	binary    string
+	buildErr  error
+)
+
+// gmvBinary builds gmv once for the tests that run it as a command
+func gmvBinary(t *testing.T) string {
+	buildOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "gmv-bin-*")
+		if err != nil {
+			buildErr = err
+			return
+		}
+		binary = filepath.Join(dir, "gmv")
+		out, err := exec.Command("go", "build", "-o", binary, "github.com/ishrq/gmv").CombinedOutput()
+		if err != nil {
+			buildErr = &buildError{err, string(out)}
+		}
+	})
+	if buildErr != nil {
+		t.Skipf("Cannot build gmv: %v", buildErr)
+	}
+	return binary
+}
+
+type buildError struct {
+	err    error
+	output string
+}
+
+func (e *buildError) Error() string {
+	return e.err.Error() + ": " + e.output
+}
+
+// runGmv runs gmv in dir, with its state kept under dir and an editor that
+// applies the sed script to the buffer. It returns the combined output.
+func runGmv(t *testing.T, dir, script string, args ...string) (string, error) {
+	editor := filepath.Join(dir, ".state", "editor.sh")
+	if err := os.MkdirAll(filepath.Dir(editor), 0755); err != nil {
+		t.Fatalf("Failed to create state dir: %v", err)
+	}
+	content := "#!/bin/sh\nsed -e \"$GMV_TEST_SED\" \"$1\" > \"$1.new\" && mv \"$1.new\" \"$1\"\n"
+	if err := os.WriteFile(editor, []byte(content), 0755); err != nil {
+		t.Fatalf("Failed to write editor: %v", err)
+	}
+
+	cmd := exec.Command(gmvBinary(t), args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"EDITOR="+editor,
+		"GMV_TEST_SED="+script,
+		"XDG_STATE_HOME="+filepath.Join(dir, ".state"),
+		"TMPDIR="+filepath.Join(dir, ".state"),
+	)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestCLIOverwriteIsStashed(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a", "b"})
+	defer cleanup()
+	writeContents(t, []string{filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b")})
+
+	if out, err := runGmv(t, tmpDir, "s/^a$/b/", "--force", "a"); err != nil {
+		t.Fatalf("gmv failed: %v\n%s", err, out)
+	}
+	checkContent(t, filepath.Join(tmpDir, "b"), "a")
+
+	if out, err := runGmv(t, tmpDir, "", "undo"); err != nil {
+		t.Fatalf("gmv undo failed: %v\n%s", err, out)
+	}
+	checkContent(t, filepath.Join(tmpDir, "a"), "a")
+	checkContent(t, filepath.Join(tmpDir, "b"), "b")
+}
+
+func TestCLIDryRunLeavesNoSession(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a"})
+	defer cleanup()
+
+	if out, err := runGmv(t, tmpDir, "s/^a$/b/", "--dry-run", "a"); err != nil {
+		t.Fatalf("gmv --dry-run failed: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "a")); err != nil {
+		t.Errorf("Expected a to be left alone by a dry run: %v", err)
+	}
+
+	out, err := runGmv(t, tmpDir, "", "--resume")
+	if err == nil || !strings.Contains(out, "no unfinished session") {
+		t.Errorf("Expected no session to resume after a dry run, got: %v\n%s", err, out)
+	}
+}
+
+func TestCLIUndoKeepsCycleGroup(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a", "b", "c"})
+	defer cleanup()
+	writeContents(t, []string{filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b"), filepath.Join(tmpDir, "c")})
+
+	if out, err := runGmv(t, tmpDir, "1s/.*/b/;2s/.*/c/;3s/.*/a/", "a", "b", "c"); err != nil {
+		t.Fatalf("gmv failed: %v\n%s", err, out)
+	}
+	checkContent(t, filepath.Join(tmpDir, "b"), "a")
+
+	out, err := runGmv(t, tmpDir, "", "undo")
+	if err != nil {
+		t.Fatalf("gmv undo failed: %v\n%s", err, out)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		checkContent(t, filepath.Join(tmpDir, name), name)
+	}
+
+	// The undo is logged with its cycle as one group
+	_, undoLog, ok := strings.Cut(out, "A log file is saved at ")
+	if !ok {
+		t.Fatalf("Expected the undo log to be named:\n%s", out)
+	}
+	content, err := os.ReadFile(strings.TrimSpace(undoLog))
+	if err != nil {
+		t.Fatalf("Failed to read undo log: %v", err)
+	}
+	if !strings.Contains(string(content), "# group of 4\n") {
+		t.Errorf("Expected the undo log to group the cycle:\n%s", content)
+	}
+}
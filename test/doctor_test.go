@@ -0,0 +1,152 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+// crashAfter plans a three-file cycle, journals it and performs only its
+// first n operations, as if gmv had been killed
+func crashAfter(t *testing.T, n int) (string, []string, func()) {
+	files := []string{"a.txt", "b.txt", "c.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	t.Setenv("XDG_STATE_HOME", filepath.Join(tmpDir, ".state"))
+	t.Setenv("TMPDIR", filepath.Join(tmpDir, ".state"))
+
+	original := []string{
+		filepath.Join(tmpDir, "a.txt"),
+		filepath.Join(tmpDir, "b.txt"),
+		filepath.Join(tmpDir, "c.txt"),
+	}
+	writeContents(t, original)
+	edited := []string{original[1], original[2], original[0]}
+
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if !strings.HasPrefix(filepath.Base(plan[0].To), rename.TempPrefix+rename.SessionID+"_") {
+		t.Fatalf("Temp name does not encode the session: %s", plan[0].To)
+	}
+	if err := rename.WriteJournal(plan); err != nil {
+		t.Fatalf("Write journal failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan[:n], false); err != nil {
+		t.Fatalf("Partial execute failed: %v", err)
+	}
+
+	return tmpDir, original, cleanup
+}
+
+func runRecovery(t *testing.T, dir string) {
+	recovery, err := rename.PlanRecovery([]string{dir})
+	if err != nil {
+		t.Fatalf("Plan recovery failed: %v", err)
+	}
+	if len(recovery.Unresolved) != 0 {
+		t.Fatalf("Unexpected unresolved temp files: %v", recovery.Unresolved)
+	}
+	if len(recovery.Plan) != 1 {
+		t.Fatalf("Expected one restore, got %v", recovery.Plan)
+	}
+	if err := rename.SimulateReplay(recovery.Plan); err != nil {
+		t.Fatalf("Recovery plan rejected: %v", err)
+	}
+	if err := rename.ExecuteRenames(recovery.Plan, false); err != nil {
+		t.Fatalf("Recovery failed: %v", err)
+	}
+}
+
+func TestDoctorRestoresTempToOriginalName(t *testing.T) {
+	// Killed right after the first file went to the temp name: its
+	// intended name is still taken, so it goes back where it was
+	tmpDir, original, cleanup := crashAfter(t, 1)
+	defer cleanup()
+
+	runRecovery(t, tmpDir)
+	for _, file := range original {
+		checkContent(t, file, filepath.Base(file))
+	}
+}
+
+func TestDoctorCompletesInterruptedCycle(t *testing.T) {
+	// Killed just before the temp file was moved to its final name
+	tmpDir, original, cleanup := crashAfter(t, 3)
+	defer cleanup()
+
+	runRecovery(t, tmpDir)
+	checkContent(t, original[0], "c.txt")
+	checkContent(t, original[1], "a.txt")
+	checkContent(t, original[2], "b.txt")
+}
+
+func TestDoctorReportsUnknownTemp(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{".gmv_temp_1700000000000000000", ".gmv_temp_deadbeef_1"})
+	defer cleanup()
+	t.Setenv("XDG_STATE_HOME", filepath.Join(tmpDir, ".state"))
+	t.Setenv("TMPDIR", filepath.Join(tmpDir, ".state"))
+	os.MkdirAll(filepath.Join(tmpDir, ".state"), 0755)
+
+	recovery, err := rename.PlanRecovery([]string{tmpDir})
+	if err != nil {
+		t.Fatalf("Plan recovery failed: %v", err)
+	}
+	if len(recovery.Plan) != 0 || len(recovery.Unresolved) != 2 {
+		t.Errorf("Expected two unresolved temp files, got plan %v, unresolved %v", recovery.Plan, recovery.Unresolved)
+	}
+}
+
+func TestDoctorScansRelativeDir(t *testing.T) {
+	// A plain "gmv doctor" scans "." and the journal names the same
+	// directory by its absolute path: the temp file is found only once
+	tmpDir, original, cleanup := crashAfter(t, 1)
+	defer cleanup()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd failed: %v", err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatalf("Chdir failed: %v", err)
+	}
+	defer os.Chdir(cwd)
+
+	runRecovery(t, ".")
+	for _, file := range original {
+		checkContent(t, file, filepath.Base(file))
+	}
+}
+
+func TestDoctorKeepsJournalOfRunningSession(t *testing.T) {
+	// A journaled session with no temp files yet may still be running
+	tmpDir, original, cleanup := crashAfter(t, 0)
+	defer cleanup()
+	journal := filepath.Join(tmpDir, ".state", "gmv", "journal", rename.SessionID)
+
+	recovery, err := rename.PlanRecovery([]string{tmpDir})
+	if err != nil {
+		t.Fatalf("Plan recovery failed: %v", err)
+	}
+	if len(recovery.Plan) != 0 || len(recovery.Sessions) != 1 {
+		t.Fatalf("Expected one session with nothing to restore, got plan %v, sessions %v", recovery.Plan, recovery.Sessions)
+	}
+
+	locks, err := rename.LockDirs(original)
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	recovery.RemoveJournals()
+	if _, err := os.Stat(journal); err != nil {
+		t.Errorf("Journal of a locked session was removed: %v", err)
+	}
+
+	locks.Release()
+	recovery.RemoveJournals()
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("Journal of a finished session was kept: %v", err)
+	}
+}
@@ -1,12 +1,18 @@
 package test
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/ishrq/gmv/internal/rename"
+	"github.com/ishrq/gmv/internal/tui"
 )
 
 // setupTestFiles creates temporary files and directories for testing
@@ -196,9 +202,9 @@ func TestSimpleSwap(t *testing.T) {
 		t.Fatalf("Build plan failed: %v", err)
 	}
 
-	// Should have extra operations for the swap (using temp file)
-	if len(plan) < 2 {
-		t.Errorf("Expected at least 2 operations for swap, got %d", len(plan))
+	// A swap is a single exchange operation
+	if len(plan) != 1 || plan[0].Kind != rename.OpExchange {
+		t.Errorf("Expected a single exchange for swap, got %v", plan)
 	}
 
 	if err := rename.ExecuteRenames(plan, false); err != nil {
@@ -403,6 +409,230 @@ func TestDirectoryChangeNotAllowed(t *testing.T) {
 	}
 }
 
+func TestInvalidTargetNames(t *testing.T) {
+	files := []string{"file.txt", "other.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	original := []string{
+		filepath.Join(tmpDir, "file.txt"),
+		filepath.Join(tmpDir, "other.txt"),
+	}
+	tests := []struct {
+		name, edit, message string
+	}{
+		{"dot", tmpDir + "/.", "is not a valid file name"},
+		{"dot dot", tmpDir + "/..", "is not a valid file name"},
+		{"slash", filepath.Join(tmpDir, "a/b.txt"), "cannot contain '/'"},
+		{"nul", filepath.Join(tmpDir, "a\x00b"), "NUL byte"},
+		{"control", filepath.Join(tmpDir, "a\tb"), "control character"},
+		{"too long", filepath.Join(tmpDir, strings.Repeat("x", 256)), "bytes long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rename.ValidateEdits(original, []string{tt.edit, original[1]})
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("Expected error containing %q, got %v", tt.message, err)
+			}
+		})
+	}
+
+	// x.txt and ./x.txt are the same target
+	err := rename.ValidateEdits(original, []string{filepath.Join(tmpDir, "x.txt"), tmpDir + "/./x.txt"})
+	if err == nil || !strings.Contains(err.Error(), "duplicate target filename") {
+		t.Errorf("Expected duplicate error, got %v", err)
+	}
+
+	edited := rename.CleanPaths([]string{tmpDir + "/./file.txt", tmpDir + "//y.txt"})
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if len(plan) != 1 || plan[0].To != filepath.Join(tmpDir, "y.txt") {
+		t.Errorf("Expected a single rename to y.txt, got %v", plan)
+	}
+}
+
+// caseInsensitive reports whether dir ignores case in file names
+func caseInsensitive(t *testing.T, dir string) bool {
+	probe := filepath.Join(dir, "CaseProbe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatalf("Failed to create probe: %v", err)
+	}
+	defer os.Remove(probe)
+	_, err := os.Lstat(filepath.Join(dir, "caseprobe"))
+	return err == nil
+}
+
+func TestCaseOnlyRename(t *testing.T) {
+	files := []string{"Readme.md", "notes.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	folding := caseInsensitive(t, tmpDir)
+
+	original := []string{filepath.Join(tmpDir, "Readme.md"), filepath.Join(tmpDir, "notes.txt")}
+	writeContents(t, original)
+	edited := []string{filepath.Join(tmpDir, "README.md"), filepath.Join(tmpDir, "NOTES.txt")}
+
+	if err := rename.ValidateEdits(original, edited); err != nil {
+		t.Fatalf("Validation failed: %v", err)
+	}
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if overwrites := rename.CheckOverwrites(plan, original); len(overwrites) > 0 {
+		t.Errorf("Case-only renames reported as overwrites: %v", overwrites)
+	}
+	if folding && len(plan) != 4 {
+		t.Errorf("Expected each rename to go through a temp file, got %v", plan)
+	}
+	if err := rename.SimulatePlan(original, edited, plan); err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	checkContent(t, edited[0], "Readme.md")
+	checkContent(t, edited[1], "notes.txt")
+	entries, _ := os.ReadDir(tmpDir)
+	for _, entry := range entries {
+		if entry.Name() != "README.md" && entry.Name() != "NOTES.txt" {
+			t.Errorf("Unexpected entry %s after renaming", entry.Name())
+		}
+	}
+
+	// Targets that differ only in case collide where case is ignored
+	original = edited
+	edited = []string{filepath.Join(tmpDir, "x.md"), filepath.Join(tmpDir, "X.md")}
+	err = rename.ValidateEdits(original, edited)
+	if folding && err == nil {
+		t.Error("Expected x.md and X.md to be duplicates")
+	} else if !folding && err != nil {
+		t.Errorf("Expected x.md and X.md to be distinct, got %v", err)
+	}
+}
+
+func TestHardLinkIsNotCaseFolding(t *testing.T) {
+	files := []string{"a.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	if caseInsensitive(t, tmpDir) {
+		t.Skip("temp directory ignores case")
+	}
+
+	// A.TXT is another name for a.txt, not the same entry
+	a, upper := filepath.Join(tmpDir, "a.txt"), filepath.Join(tmpDir, "A.TXT")
+	if err := os.Link(a, upper); err != nil {
+		t.Skipf("Hard links not supported: %v", err)
+	}
+	other := filepath.Join(tmpDir, "b.txt")
+	if err := os.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := []rename.RenameOp{{From: other, To: upper}}
+	overwrites := rename.CheckOverwrites(plan, []string{a, other})
+	if len(overwrites) != 1 || overwrites[0] != upper {
+		t.Errorf("Expected %s to be reported as overwritten, got %v", upper, overwrites)
+	}
+}
+
+func TestDirectoryTrailingSlash(t *testing.T) {
+	files := []string{"dir1/", "dir2/", "file.txt", "taken.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	// The shell passes dir1/ for */, which is the same file as dir1
+	original := rename.CleanPaths([]string{tmpDir + "/dir1/", tmpDir + "/dir2/", filepath.Join(tmpDir, "file.txt")})
+	marked := rename.MarkTypes(original, original)
+	if marked[0] != filepath.Join(tmpDir, "dir1")+"/" || marked[2] != filepath.Join(tmpDir, "file.txt") {
+		t.Errorf("Expected only directories to be marked, got %v", marked)
+	}
+
+	edited := []string{filepath.Join(tmpDir, "new") + "/", filepath.Join(tmpDir, "dir2") + "/", original[2]}
+	if err := rename.ValidateEdits(original, edited); err != nil {
+		t.Fatalf("Validation failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		edited  []string
+		message string
+	}{
+		{"slash on a file", []string{marked[0], marked[1], filepath.Join(tmpDir, "new.txt") + "/"}, "is not a directory"},
+		{"directory onto a file", []string{filepath.Join(tmpDir, "taken.txt"), marked[1], original[2]}, "cannot rename directory"},
+		{"file onto a directory", []string{filepath.Join(tmpDir, "x"), marked[1], filepath.Join(tmpDir, "dir1")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rename.ValidateEdits(original, tt.edited)
+			if tt.message == "" {
+				if err != nil {
+					t.Errorf("Expected dir1 to be free once renamed, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("Expected error containing %q, got %v", tt.message, err)
+			}
+		})
+	}
+
+	err := rename.ValidateEdits(original[2:], []string{filepath.Join(tmpDir, "dir1")})
+	if err == nil || !strings.Contains(err.Error(), "cannot rename file") {
+		t.Errorf("Expected renaming a file onto a directory to be rejected, got %v", err)
+	}
+}
+
+func TestDanglingSymlinks(t *testing.T) {
+	files := []string{"file.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	link, other := filepath.Join(tmpDir, "link"), filepath.Join(tmpDir, "other")
+	for _, path := range []string{link, other} {
+		if err := os.Symlink("missing", path); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	original := []string{link, filepath.Join(tmpDir, "file.txt")}
+	if err := rename.ValidateFiles(original); err != nil {
+		t.Fatalf("Dangling symlink rejected: %v", err)
+	}
+
+	marked := rename.MarkTypes(original, original)
+	if marked[0] != link+"@" || marked[1] != original[1] {
+		t.Errorf("Expected only the link to be marked, got %v", marked)
+	}
+	edited := rename.UnmarkLinks(original, []string{filepath.Join(tmpDir, "new@"), marked[1]})
+	if edited[0] != filepath.Join(tmpDir, "new") {
+		t.Errorf("Expected the marker to be removed, got %s", edited[0])
+	}
+
+	// A dangling link in the way is overwritten like any other file
+	plan, err := rename.BuildRenamePlan(original, []string{link, other})
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if overwrites := rename.CheckOverwrites(plan, original); len(overwrites) != 1 || overwrites[0] != other {
+		t.Errorf("Expected %s to be reported as overwritten, got %v", other, overwrites)
+	}
+
+	plan, err = rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if target, err := os.Readlink(edited[0]); err != nil || target != "missing" {
+		t.Errorf("Expected the link itself to be renamed, got %q, %v", target, err)
+	}
+}
+
 func TestNoChanges(t *testing.T) {
 	files := []string{"file1.txt", "file2.txt"}
 	tmpDir, cleanup := setupTestFiles(t, files)
@@ -567,6 +797,736 @@ func TestNoOverwriteWhenTargetDoesNotExist(t *testing.T) {
 	}
 }
 
+func TestConflictsPreview(t *testing.T) {
+	files := []string{"file1.txt", "file2.txt", "file3.txt", "existing.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	original := []string{
+		filepath.Join(tmpDir, "file1.txt"),
+		filepath.Join(tmpDir, "file2.txt"),
+		filepath.Join(tmpDir, "file3.txt"),
+	}
+	edited := []string{
+		filepath.Join(tmpDir, "existing.txt"),
+		filepath.Join(tmpDir, "sub", "file2.txt"),
+		filepath.Join(tmpDir, "file3.txt"),
+	}
+
+	conflicts := rename.Conflicts(original, edited)
+
+	if !conflicts[0].Overwrite {
+		t.Errorf("Expected overwrite warning for line 1, got %+v", conflicts[0])
+	}
+	if conflicts[1].Message == "" || conflicts[1].Overwrite {
+		t.Errorf("Expected directory change error for line 2, got %+v", conflicts[1])
+	}
+	if conflicts[2].Message != "" {
+		t.Errorf("Expected no conflict for unchanged line 3, got %+v", conflicts[2])
+	}
+
+	// Duplicates are flagged on every line involved
+	edited = []string{
+		filepath.Join(tmpDir, "same.txt"),
+		filepath.Join(tmpDir, "same.txt"),
+		filepath.Join(tmpDir, "file3.txt"),
+	}
+	conflicts = rename.Conflicts(original, edited)
+	if conflicts[0].Message == "" || conflicts[1].Message == "" {
+		t.Errorf("Expected duplicate conflicts on both lines, got %+v", conflicts)
+	}
+}
+
+func TestWordDiff(t *testing.T) {
+	before, after := tui.WordDiff("holiday-photo-001.jpg", "holiday-picture-001.jpg")
+
+	changedText := func(segments []tui.Segment) string {
+		text := ""
+		for _, s := range segments {
+			if s.Changed {
+				text += s.Text
+			}
+		}
+		return text
+	}
+
+	if got := changedText(before); got != "photo" {
+		t.Errorf("Expected only 'photo' to be removed, got %q", got)
+	}
+	if got := changedText(after); got != "picture" {
+		t.Errorf("Expected only 'picture' to be added, got %q", got)
+	}
+
+	// Joining the segments must give back the original names
+	join := func(segments []tui.Segment) string {
+		text := ""
+		for _, s := range segments {
+			text += s.Text
+		}
+		return text
+	}
+	if join(before) != "holiday-photo-001.jpg" || join(after) != "holiday-picture-001.jpg" {
+		t.Errorf("Segments do not reassemble the names: %q, %q", join(before), join(after))
+	}
+}
+
+func TestChainRename(t *testing.T) {
+	files := []string{"a.txt", "b.txt", "c.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	original := []string{
+		filepath.Join(tmpDir, "a.txt"),
+		filepath.Join(tmpDir, "b.txt"),
+		filepath.Join(tmpDir, "c.txt"),
+	}
+	writeContents(t, original)
+	// Chain without a cycle: a->b, b->c, c->d
+	edited := []string{
+		filepath.Join(tmpDir, "b.txt"),
+		filepath.Join(tmpDir, "c.txt"),
+		filepath.Join(tmpDir, "d.txt"),
+	}
+
+	if err := rename.ValidateEdits(original, edited); err != nil {
+		t.Fatalf("Validation failed: %v", err)
+	}
+
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute renames failed: %v", err)
+	}
+
+	// Every file must keep its content under the new name
+	for i := range original {
+		checkContent(t, edited[i], filepath.Base(original[i]))
+	}
+}
+
+func TestSkipRenamesCascades(t *testing.T) {
+	original := []string{"a", "b", "c", "d", "x"}
+	// Cycle a->b->c->a, independent d->e, chain x->d
+	edited := []string{"b", "c", "a", "e", "d"}
+
+	// Skipping one link of a cycle drops the whole cycle
+	result, cascaded := rename.SkipRenames(original, edited, map[int]bool{1: true})
+	expected := []string{"a", "b", "c", "e", "d"}
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Errorf("Line %d: expected %s, got %s", i, expected[i], result[i])
+		}
+	}
+	if len(cascaded) != 2 || cascaded[0] != 0 || cascaded[1] != 2 {
+		t.Errorf("Expected lines 0 and 2 to cascade, got %v", cascaded)
+	}
+
+	// Skipping the end of a chain drops the renames leading into it
+	result, cascaded = rename.SkipRenames(original, edited, map[int]bool{3: true})
+	if result[4] != "x" {
+		t.Errorf("Expected x->d to be skipped, got x->%s", result[4])
+	}
+	if len(cascaded) != 1 || cascaded[0] != 4 {
+		t.Errorf("Expected line 4 to cascade, got %v", cascaded)
+	}
+
+	// Skipping the start of a chain does not affect the rest
+	_, cascaded = rename.SkipRenames(original, edited, map[int]bool{4: true})
+	if len(cascaded) != 0 {
+		t.Errorf("Expected no cascade, got %v", cascaded)
+	}
+}
+
+func TestRenameNeverClobbersUnconfirmedTarget(t *testing.T) {
+	files := []string{"file1.txt", "existing.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	source := filepath.Join(tmpDir, "file1.txt")
+	target := filepath.Join(tmpDir, "existing.txt")
+	writeContents(t, []string{source, target})
+
+	// The target appeared after the overwrite check, so it was never confirmed
+	plan := []rename.RenameOp{{From: source, To: target}}
+	if err := rename.ExecuteRenames(plan, false); err == nil {
+		t.Fatal("Expected rename onto an existing file to fail")
+	}
+	checkContent(t, target, "existing.txt")
+	checkContent(t, source, "file1.txt")
+
+	// Once confirmed, the overwrite goes ahead
+	rename.MarkOverwrites(plan, []string{target})
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Confirmed overwrite failed: %v", err)
+	}
+	checkContent(t, target, "file1.txt")
+}
+
+func TestSwapExchangesContents(t *testing.T) {
+	files := []string{"fileA.txt", "fileB.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	original := []string{
+		filepath.Join(tmpDir, "fileA.txt"),
+		filepath.Join(tmpDir, "fileB.txt"),
+	}
+	writeContents(t, original)
+	edited := []string{original[1], original[0]}
+
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute renames failed: %v", err)
+	}
+	checkContent(t, original[0], "fileB.txt")
+	checkContent(t, original[1], "fileA.txt")
+
+	// Undoing an exchange swaps back
+	if err := rename.ExecuteRenames(rename.UndoPlan(plan), false); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	checkContent(t, original[0], "fileA.txt")
+	checkContent(t, original[1], "fileB.txt")
+
+	entries, _ := os.ReadDir(tmpDir)
+	if len(entries) != 2 {
+		t.Errorf("Expected no temp files to remain, found %d entries", len(entries))
+	}
+}
+
+func TestExecuteRefusesSwappedDirectory(t *testing.T) {
+	files := []string{"data/file1.txt", "other/file1.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	dataDir := filepath.Join(tmpDir, "data")
+	original := []string{filepath.Join(dataDir, "file1.txt")}
+	edited := []string{filepath.Join(dataDir, "renamed.txt")}
+
+	dirs, err := rename.SnapshotDirs(original)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+
+	// Swap the directory for a symlink to another one after validation
+	if err := os.Rename(dataDir, filepath.Join(tmpDir, "data.old")); err != nil {
+		t.Fatalf("Failed to move directory: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(tmpDir, "other"), dataDir); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	if err := rename.Execute(plan, rename.ExecOptions{Dirs: dirs}); err == nil {
+		t.Fatal("Expected execution to refuse a swapped directory")
+	}
+	if !fileExists(filepath.Join(tmpDir, "other", "file1.txt")) {
+		t.Error("File in the symlinked directory was renamed")
+	}
+
+	// A real directory recreated under the old name is refused too
+	os.Remove(dataDir)
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatalf("Failed to recreate directory: %v", err)
+	}
+	if err := os.WriteFile(original[0], []byte("new"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := rename.Execute(plan, rename.ExecOptions{Dirs: dirs}); err == nil {
+		t.Fatal("Expected execution to refuse a recreated directory")
+	}
+	if !fileExists(original[0]) {
+		t.Error("File in the recreated directory was renamed")
+	}
+}
+
+func TestKeepGoingSkipsDependents(t *testing.T) {
+	files := []string{"a.txt", "b.txt", "c.txt", "p.txt", "q.txt", "r.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+	original := []string{path("a.txt"), path("b.txt"), path("c.txt"), path("p.txt"), path("q.txt"), path("r.txt")}
+	edited := []string{path("a2.txt"), path("a.txt"), path("c2.txt"), path("q.txt"), path("r.txt"), path("p.txt")}
+	writeContents(t, original)
+
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+
+	// a.txt and r.txt vanish, so a -> a2 fails, b -> a depends on it, and
+	// the p -> q -> r -> p cycle fails part way and is rolled back
+	os.Remove(path("a.txt"))
+	os.Remove(path("r.txt"))
+
+	err = rename.Execute(plan, rename.ExecOptions{KeepGoing: true})
+	var execErr *rename.ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("Expected an ExecError, got %v", err)
+	}
+
+	if len(execErr.Done) != 1 || execErr.Done[0].To != path("c2.txt") {
+		t.Errorf("Expected only c -> c2 to be done, got %v", execErr.Done)
+	}
+	if len(execErr.Failed) != 2 {
+		t.Errorf("Expected 2 failures, got %v", execErr.Failed)
+	}
+	if len(execErr.RolledBack) != 1 {
+		t.Errorf("Expected the cycle's first step to be rolled back, got %v", execErr.RolledBack)
+	}
+
+	skipped := make(map[string]bool)
+	for _, op := range execErr.Skipped {
+		skipped[op.From] = true
+	}
+	if !skipped[path("b.txt")] || !skipped[path("q.txt")] {
+		t.Errorf("Expected b -> a and the rest of the cycle to be skipped, got %v", execErr.Skipped)
+	}
+
+	checkContent(t, path("b.txt"), "b.txt")
+	checkContent(t, path("c2.txt"), "c.txt")
+	checkContent(t, path("p.txt"), "p.txt")
+	checkContent(t, path("q.txt"), "q.txt")
+}
+
+func TestPreflightBlockers(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a.txt", "locked/b.txt"})
+	defer cleanup()
+
+	a := filepath.Join(tmpDir, "a.txt")
+	plan := []rename.RenameOp{{From: a, To: filepath.Join(tmpDir, "c.txt")}}
+	if blockers := rename.Preflight(plan); len(blockers) != 0 {
+		t.Errorf("Expected no blockers, got %v", blockers)
+	}
+
+	// /proc is a mount point on Linux
+	var root, proc syscall.Stat_t
+	if syscall.Stat("/", &root) == nil && syscall.Stat("/proc", &proc) == nil && root.Dev != proc.Dev {
+		blockers := rename.Preflight([]rename.RenameOp{{From: "/proc", To: "/proc2"}})
+		if !containsMessage(blockers, "/proc is a mount point") {
+			t.Errorf("Expected /proc to be reported as a mount point, got %v", blockers)
+		}
+	}
+
+	// Permissions do not apply to root
+	if os.Getuid() != 0 {
+		locked := filepath.Join(tmpDir, "locked")
+		if err := os.Chmod(locked, 0555); err != nil {
+			t.Fatalf("Failed to lock directory: %v", err)
+		}
+		defer os.Chmod(locked, 0755)
+
+		plan = append(plan, rename.RenameOp{From: filepath.Join(locked, "b.txt"), To: filepath.Join(locked, "d.txt")})
+		blockers := rename.Preflight(plan)
+		if len(blockers) != 1 || !containsMessage(blockers, "no write permission in directory "+locked) {
+			t.Errorf("Expected the locked directory to be reported, got %v", blockers)
+		}
+	}
+}
+
+func containsMessage(messages []string, message string) bool {
+	for _, m := range messages {
+		if m == message {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFindBusyWorkingDirectory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("busy file detection needs /proc")
+	}
+
+	tmpDir, cleanup := setupTestFiles(t, []string{"busy/", "idle/"})
+	defer cleanup()
+
+	cmd := exec.Command("sleep", "10")
+	cmd.Dir = filepath.Join(tmpDir, "busy")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	busyDir := filepath.Join(tmpDir, "busy")
+	busy := rename.FindBusy([]string{busyDir, filepath.Join(tmpDir, "idle")})
+	if len(busy) != 1 || busy[0].Path != busyDir || busy[0].PID != cmd.Process.Pid {
+		t.Errorf("Expected only %s to be busy with pid %d, got %v", busyDir, cmd.Process.Pid, busy)
+	}
+}
+
+func TestExecuteRefusesChangedSources(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a.txt", "b.txt", "c.txt"})
+	defer cleanup()
+
+	a := filepath.Join(tmpDir, "a.txt")
+	b := filepath.Join(tmpDir, "b.txt")
+	c := filepath.Join(tmpDir, "c.txt")
+	writeContents(t, []string{a, b, c})
+
+	sources, err := rename.FingerprintFiles([]string{a, b, c})
+	if err != nil {
+		t.Fatalf("Fingerprint failed: %v", err)
+	}
+	plan, err := rename.BuildRenamePlan([]string{a, b, c}, []string{a + "2", b + "2", c + "2"})
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+
+	// Replace a.txt with a different file of the same name, and append
+	// to b.txt, while the editor is open
+	if err := os.WriteFile(a+".new", []byte("a.txt"), 0644); err != nil {
+		t.Fatalf("Failed to create replacement: %v", err)
+	}
+	if err := os.Rename(a+".new", a); err != nil {
+		t.Fatalf("Failed to replace %s: %v", a, err)
+	}
+	f, err := os.OpenFile(b, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", b, err)
+	}
+	f.WriteString("more")
+	f.Close()
+
+	err = rename.Execute(plan, rename.ExecOptions{Sources: sources})
+	if err == nil {
+		t.Fatal("Expected execution to refuse changed files")
+	}
+	for _, want := range []string{a + " was replaced", b + " was modified"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in error, got: %v", want, err)
+		}
+	}
+
+	for _, path := range []string{a, b, c} {
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("Expected %s to be left in place: %v", path, err)
+		}
+	}
+}
+
+// makeDeepDir creates a directory under dir whose path is longer than
+// PATH_MAX, one level at a time, holding files with their own names as
+// content. The returned func removes it again, as os.RemoveAll cannot
+// reach it.
+func makeDeepDir(t *testing.T, dir string, files ...string) (string, func()) {
+	if runtime.GOOS != "linux" {
+		t.Skip("paths longer than PATH_MAX are walked on Linux only")
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd failed: %v", err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir failed: %v", err)
+	}
+
+	deep := dir
+	component := strings.Repeat("d", 200)
+	for len(deep) < 4400 {
+		if err := os.Mkdir(component, 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		if err := os.Chdir(component); err != nil {
+			t.Fatalf("Chdir failed: %v", err)
+		}
+		deep = filepath.Join(deep, component)
+	}
+	for _, name := range files {
+		if err := os.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	return deep, func() {
+		defer os.Chdir(cwd)
+		if os.Chdir(deep) != nil {
+			return
+		}
+		entries, _ := os.ReadDir(".")
+		for _, e := range entries {
+			os.Remove(e.Name())
+		}
+		for d := deep; d != dir; d = filepath.Dir(d) {
+			os.Chdir("..")
+			os.Remove(component)
+		}
+	}
+}
+
+func TestFingerprintDeepPath(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, nil)
+	defer cleanup()
+	deep, removeDeep := makeDeepDir(t, tmpDir, "a.txt")
+	defer removeDeep()
+
+	original := []string{filepath.Join(deep, "a.txt")}
+	edited := []string{filepath.Join(deep, "b.txt")}
+	sources, err := rename.FingerprintFiles(original)
+	if err != nil {
+		t.Fatalf("Fingerprint failed: %v", err)
+	}
+	plan := []rename.RenameOp{{From: original[0], To: edited[0]}}
+	if err := rename.Execute(plan, rename.ExecOptions{Sources: sources}); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+}
+
+func TestLockDirsExcludesSecondSession(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a.txt", "sub/b.txt"})
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+
+	files := []string{filepath.Join(tmpDir, "sub", "b.txt"), filepath.Join(tmpDir, "a.txt")}
+	locks, err := rename.LockDirs(files)
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	// flock locks belong to the open directory, so a second lock from the
+	// same process conflicts like one from another session
+	_, err = rename.LockDirs([]string{filepath.Join(tmpDir, "sub", "c.txt")})
+	if err == nil {
+		t.Fatal("Expected the second lock to fail")
+	}
+	if want := fmt.Sprintf("pid %d", os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected the holder %q in the error, got: %v", want, err)
+	}
+
+	locks.Release()
+	again, err := rename.LockDirs(files)
+	if err != nil {
+		t.Fatalf("Lock after release failed: %v", err)
+	}
+	again.Release()
+}
+
+func TestLockAddsPlanDirs(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a.txt", "links/l"})
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+
+	a := filepath.Join(tmpDir, "a.txt")
+	locks, err := rename.LockDirs([]string{a})
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	defer locks.Release()
+
+	// Directories already held are skipped rather than locked twice
+	if err := locks.Lock([]string{a, filepath.Join(tmpDir, "links", "l")}); err != nil {
+		t.Fatalf("Adding a directory failed: %v", err)
+	}
+	if other, err := rename.LockDirs([]string{filepath.Join(tmpDir, "links", "m")}); err == nil {
+		other.Release()
+		t.Error("Expected the added directory to be held")
+	}
+}
+
+func TestExecuteStopsBeforeNextOperation(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a.txt", "b.txt"})
+	defer cleanup()
+
+	a := filepath.Join(tmpDir, "a.txt")
+	b := filepath.Join(tmpDir, "b.txt")
+	plan := []rename.RenameOp{{From: a, To: a + "2"}, {From: b, To: b + "2"}}
+
+	stop := make(chan struct{})
+	close(stop)
+	err := rename.Execute(plan, rename.ExecOptions{Stop: stop})
+
+	var execErr *rename.ExecError
+	if !errors.As(err, &execErr) || !errors.Is(err, rename.ErrInterrupted) {
+		t.Fatalf("Expected an interrupted ExecError, got %v", err)
+	}
+	if len(execErr.Done) != 0 || len(execErr.Pending) != 2 {
+		t.Errorf("Expected nothing done and 2 pending, got %v and %v", execErr.Done, execErr.Pending)
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("Expected %s to be left in place: %v", path, err)
+		}
+	}
+}
+
+func TestExecuteObserverEvents(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"p.txt", "q.txt", "r.txt"})
+	defer cleanup()
+
+	p := filepath.Join(tmpDir, "p.txt")
+	q := filepath.Join(tmpDir, "q.txt")
+	r := filepath.Join(tmpDir, "r.txt")
+	plan, err := rename.BuildRenamePlan([]string{p, q, r}, []string{q, r, p})
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+
+	// The cycle fails at its second step, r -> p
+	os.Remove(r)
+
+	var kinds []rename.EventKind
+	observer := rename.ObserverFunc(func(e rename.Event) {
+		kinds = append(kinds, e.Kind)
+	})
+	rename.Execute(plan, rename.ExecOptions{KeepGoing: true, Observer: observer})
+
+	expected := []rename.EventKind{
+		rename.EventPlanned, rename.EventPlanned, rename.EventPlanned, rename.EventPlanned,
+		rename.EventStarted, rename.EventDone, // p -> temp
+		rename.EventStarted, rename.EventFailed, // r -> p
+		rename.EventRolledBack,                   // p -> temp
+		rename.EventSkipped, rename.EventSkipped, // q -> r, temp -> q
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Errorf("Expected events %v, got %v", expected, kinds)
+	}
+	if _, err := os.Lstat(p); err != nil {
+		t.Errorf("Expected %s to be restored: %v", p, err)
+	}
+}
+
+func TestSimulatePlan(t *testing.T) {
+	files := []string{"a.txt", "b.txt", "c.txt", "x.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+	original := []string{path("a.txt"), path("b.txt"), path("c.txt")}
+
+	// A chain, a cycle and a swap all check out
+	for _, edited := range [][]string{
+		{path("b.txt"), path("c.txt"), path("d.txt")},
+		{path("b.txt"), path("c.txt"), path("a.txt")},
+		{path("b.txt"), path("a.txt"), path("c.txt")},
+	} {
+		plan, err := rename.BuildRenamePlan(original, edited)
+		if err != nil {
+			t.Fatalf("Build plan failed: %v", err)
+		}
+		if err := rename.SimulatePlan(original, edited, plan); err != nil {
+			t.Errorf("Expected plan for %v to pass: %v", edited, err)
+		}
+	}
+
+	edited := []string{path("b.txt"), path("c.txt"), path("d.txt")}
+	cases := []struct {
+		name string
+		plan []rename.RenameOp
+	}{
+		// The chain in the wrong order replaces b.txt before it has moved
+		{"destructive order", []rename.RenameOp{
+			{From: path("a.txt"), To: path("b.txt"), Overwrite: true},
+			{From: path("b.txt"), To: path("c.txt"), Overwrite: true},
+			{From: path("c.txt"), To: path("d.txt")},
+		}},
+		{"unconfirmed overwrite", []rename.RenameOp{
+			{From: path("c.txt"), To: path("x.txt")},
+		}},
+		{"temp file left", []rename.RenameOp{
+			{From: path("c.txt"), To: path("d.txt")},
+			{From: path("b.txt"), To: path("c.txt")},
+			{From: path("a.txt"), To: path("b.txt")},
+			{From: path("x.txt"), To: path(rename.TempPrefix + "1")},
+		}},
+	}
+	for _, c := range cases {
+		err := rename.SimulatePlan(original, edited, c.plan)
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", c.name)
+		} else if c.name == "temp file left" && !strings.Contains(err.Error(), "left behind") {
+			t.Errorf("Expected the temp file to be reported, got: %v", err)
+		}
+	}
+}
+
+func TestSimulatePlanDeepPath(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, nil)
+	defer cleanup()
+	deep, removeDeep := makeDeepDir(t, tmpDir, "a.txt", "b.txt")
+	defer removeDeep()
+
+	path := func(name string) string { return filepath.Join(deep, name) }
+	original := []string{path("a.txt"), path("b.txt")}
+	edited := []string{path("b.txt"), path("c.txt")}
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if err := rename.SimulatePlan(original, edited, plan); err != nil {
+		t.Errorf("Expected deep chain to pass: %v", err)
+	}
+
+	// b.txt is found, though its path is longer than PATH_MAX
+	plan = []rename.RenameOp{{From: path("a.txt"), To: path("b.txt")}}
+	err = rename.SimulatePlan(original[:1], []string{path("b.txt")}, plan)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected deep overwrite to be rejected, got: %v", err)
+	}
+}
+
+func TestSimulatePlanLookupError(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a.txt"})
+	defer cleanup()
+
+	// A path through a symlink loop cannot be told to be free
+	loop := filepath.Join(tmpDir, "loop")
+	if err := os.Symlink("loop", loop); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	original := []string{filepath.Join(tmpDir, "a.txt")}
+	edited := []string{filepath.Join(loop, "a.txt")}
+	plan := []rename.RenameOp{{From: original[0], To: edited[0]}}
+	err := rename.SimulatePlan(original, edited, plan)
+	if err == nil || !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("Expected the lookup error, got: %v", err)
+	}
+}
+
+func TestSimulateReplay(t *testing.T) {
+	files := []string{"a.txt", "b.txt", "c.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+	original := []string{path("a.txt"), path("b.txt"), path("c.txt")}
+	edited := []string{path("b.txt"), path("c.txt"), path("a.txt")}
+
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	// The undo of a cycle goes through a temp file and checks out
+	if err := rename.SimulateReplay(rename.UndoPlan(plan)); err != nil {
+		t.Errorf("Expected the undo plan to pass: %v", err)
+	}
+
+	// One that strands a file at a temp name, or replaces a file without
+	// leave, does not
+	for _, bad := range [][]rename.RenameOp{
+		{{From: path("a.txt"), To: path(rename.TempPrefix + "1")}},
+		{{From: path("a.txt"), To: path("b.txt")}},
+	} {
+		if err := rename.SimulateReplay(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
+
 // These would need to be copied or the package structure changed to allow testing
 func validateEdits(original, edited []string) error {
 	// This is a placeholder - in real implementation, you'd import from main
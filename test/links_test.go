@@ -0,0 +1,211 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+func TestFixLinks(t *testing.T) {
+	files := []string{"lib/libfoo.so.1.2", "conf.d/a", "bin/"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+
+	links := map[string]string{
+		"bin/rel":       "../lib/libfoo.so.1.2",
+		"bin/abs":       filepath.Join(tmpDir, "lib/libfoo.so.1.2"),
+		"cfg":           "conf.d/a",
+		"conf.d/self":   "a",
+		"bin/untouched": "../lib/other",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(tmpDir, link)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	original := []string{filepath.Join(tmpDir, "lib/libfoo.so.1.2"), filepath.Join(tmpDir, "conf.d")}
+	edited := []string{filepath.Join(tmpDir, "lib/libfoo.so.1.3"), filepath.Join(tmpDir, "config.d")}
+
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	plan, err = rename.FixLinks(tmpDir, original, edited, plan)
+	if err != nil {
+		t.Fatalf("Fix links failed: %v", err)
+	}
+	if len(plan) != 5 {
+		t.Errorf("Expected 3 links to fix and 2 renames, got %v", plan)
+	}
+	if err := rename.SimulatePlan(original, edited, plan); err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"bin/rel":       "../lib/libfoo.so.1.3",
+		"bin/abs":       filepath.Join(tmpDir, "lib/libfoo.so.1.3"),
+		"cfg":           "config.d/a",
+		"config.d/self": "a",
+		"bin/untouched": "../lib/other",
+	}
+	for link, want := range expected {
+		if got, err := os.Readlink(filepath.Join(tmpDir, link)); err != nil || got != want {
+			t.Errorf("%s points to %q (%v), expected %q", link, got, err, want)
+		}
+	}
+
+	// The relinks are logged and undone with the renames
+	logPath, err := rename.WriteLog(plan)
+	if err != nil {
+		t.Fatalf("Write log failed: %v", err)
+	}
+	logged, err := rename.ReadLog(logPath)
+	if err != nil {
+		t.Fatalf("Read log failed: %v", err)
+	}
+	undo := rename.UndoPlan(logged)
+	if err := rename.VerifyPlan(undo); err != nil {
+		t.Fatalf("Undo plan rejected: %v", err)
+	}
+	if err := rename.ExecuteRenames(undo, false); err != nil {
+		t.Fatalf("Execute undo failed: %v", err)
+	}
+	for link, want := range links {
+		if got, err := os.Readlink(filepath.Join(tmpDir, link)); err != nil || got != want {
+			t.Errorf("%s points to %q (%v) after undo, expected %q", link, got, err, want)
+		}
+	}
+}
+
+func TestFixLinksRolledBackWithRename(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"a"})
+	defer cleanup()
+
+	link := filepath.Join(tmpDir, "cfg")
+	if err := os.Symlink("a", link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	original := []string{filepath.Join(tmpDir, "a")}
+	edited := []string{filepath.Join(tmpDir, "b")}
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	plan, err = rename.FixLinks(tmpDir, original, edited, plan)
+	if err != nil {
+		t.Fatalf("Fix links failed: %v", err)
+	}
+	if len(plan) != 2 || plan[0].Kind != rename.OpRelink || plan[0].Group == 0 || plan[1].Group != plan[0].Group {
+		t.Fatalf("Expected the relink in one group with its rename, got %v", plan)
+	}
+
+	// b appears as a non-empty directory after planning, so the rename
+	// fails and the relink done before it is rolled back
+	if err := os.MkdirAll(filepath.Join(tmpDir, "b", "x"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := rename.Execute(plan, rename.ExecOptions{}); err == nil {
+		t.Fatal("Expected the rename to fail")
+	}
+	if target, _ := os.Readlink(link); target != "a" {
+		t.Errorf("cfg points to %q, expected a", target)
+	}
+	if _, err := os.Stat(link); err != nil {
+		t.Errorf("Expected cfg to still resolve: %v", err)
+	}
+}
+
+func TestEditLinks(t *testing.T) {
+	files := []string{"file.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	a, b := filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b")
+	for _, link := range []string{a, b} {
+		if err := os.Symlink("old", link); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	if _, err := rename.ReadLinks([]string{a, filepath.Join(tmpDir, "file.txt")}); err == nil {
+		t.Error("Expected a regular file to be rejected")
+	}
+
+	original := []string{a, b}
+	oldTargets, err := rename.ReadLinks(original)
+	if err != nil {
+		t.Fatalf("Read links failed: %v", err)
+	}
+	lines := rename.LinkLines(original, oldTargets)
+	if lines[0] != a+" -> old" {
+		t.Errorf("Unexpected buffer line %q", lines[0])
+	}
+
+	if _, _, err := rename.SplitLinkLines([]string{a}); err == nil {
+		t.Error("Expected a line without a target to be rejected")
+	}
+	edited, newTargets, err := rename.SplitLinkLines([]string{a + " -> new -> x", filepath.Join(tmpDir, "c") + " -> old"})
+	if err != nil {
+		t.Fatalf("Split lines failed: %v", err)
+	}
+
+	plan, err := rename.BuildRenamePlan(original, edited)
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	plan = append(rename.RelinkPlan(original, oldTargets, newTargets), plan...)
+	if len(plan) != 2 || plan[0].Kind != rename.OpRelink {
+		t.Fatalf("Expected a relink and a rename, got %v", plan)
+	}
+	if err := rename.SimulatePlan(original, edited, plan); err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if target, _ := os.Readlink(a); target != "new -> x" {
+		t.Errorf("a points to %q, expected %q", target, "new -> x")
+	}
+	if target, _ := os.Readlink(edited[1]); target != "old" {
+		t.Errorf("c points to %q, expected old", target)
+	}
+
+	// A link changed since the plan was made is left alone
+	stale := []rename.RenameOp{{From: a, To: a, Kind: rename.OpRelink, OldTarget: "old", Target: "other"}}
+	if err := rename.ExecuteRenames(stale, false); err == nil {
+		t.Error("Expected a relink of a changed link to fail")
+	}
+	if target, _ := os.Readlink(a); target != "new -> x" {
+		t.Errorf("a points to %q after a refused relink", target)
+	}
+}
+
+func TestLinkConflicts(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, []string{"sub/"})
+	defer cleanup()
+
+	link := filepath.Join(tmpDir, "sub", "l")
+	if err := os.Symlink("old", link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	files := []string{link}
+
+	// A target in another directory is not a move of the link
+	conflicts := rename.LinkConflicts(files, []string{link + " -> ../elsewhere/new"})
+	if conflicts[0].Message != "" {
+		t.Errorf("Unexpected conflict for a new target: %s", conflicts[0].Message)
+	}
+
+	for _, line := range []string{filepath.Join(tmpDir, "l") + " -> old", link} {
+		if conflicts := rename.LinkConflicts(files, []string{line}); conflicts[0].Message == "" {
+			t.Errorf("Expected a conflict for %q", line)
+		}
+	}
+}
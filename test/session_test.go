@@ -0,0 +1,62 @@
+package test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+func TestSessionResume(t *testing.T) {
+	files := []string{"file1.txt", "file2.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	t.Setenv("XDG_STATE_HOME", filepath.Join(tmpDir, "state"))
+
+	original := []string{
+		filepath.Join(tmpDir, "file1.txt"),
+		filepath.Join(tmpDir, "file2.txt"),
+	}
+	sess, err := rename.NewSession(original)
+	if err != nil {
+		t.Fatalf("New session failed: %v", err)
+	}
+
+	// An untouched session offers the file list as its buffer
+	buffer, err := sess.Buffer()
+	if err != nil {
+		t.Fatalf("Read buffer failed: %v", err)
+	}
+	if len(buffer) != 2 || buffer[0] != original[0] {
+		t.Errorf("Expected the file list as buffer, got %v", buffer)
+	}
+
+	// Edits saved to the buffer survive until the session is resumed
+	edits := []string{filepath.Join(tmpDir, "renamed.txt"), original[1]}
+	if err := rename.WriteBuffer(sess.BufferPath(), edits); err != nil {
+		t.Fatalf("Write buffer failed: %v", err)
+	}
+
+	resumed, err := rename.LatestSession()
+	if err != nil {
+		t.Fatalf("Latest session failed: %v", err)
+	}
+	if resumed.Dir != sess.Dir || len(resumed.Files) != 2 || resumed.Files[1] != original[1] {
+		t.Errorf("Resumed the wrong session: %+v", resumed)
+	}
+	buffer, err = resumed.Buffer()
+	if err != nil {
+		t.Fatalf("Read buffer failed: %v", err)
+	}
+	if len(buffer) != 2 || buffer[0] != edits[0] {
+		t.Errorf("Expected edits to be kept, got %v", buffer)
+	}
+
+	// Finished sessions are cleaned up and cannot be resumed
+	if err := resumed.Remove(); err != nil {
+		t.Fatalf("Remove session failed: %v", err)
+	}
+	if _, err := rename.LatestSession(); err == nil {
+		t.Error("Expected no session to resume after removal")
+	}
+}
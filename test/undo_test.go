@@ -0,0 +1,238 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ishrq/gmv/internal/rename"
+)
+
+// writeContents stores each file's own base name in it, so renames can be
+// traced by content
+func writeContents(t *testing.T, files []string) {
+	for _, file := range files {
+		if err := os.WriteFile(file, []byte(filepath.Base(file)), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+}
+
+// checkContent verifies that path holds the content written for name
+func checkContent(t *testing.T, path, name string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("Failed to read %s: %v", path, err)
+		return
+	}
+	if string(content) != name {
+		t.Errorf("%s contains %q, expected %q", path, content, name)
+	}
+}
+
+func TestUndoLoopSession(t *testing.T) {
+	files := []string{"a.txt", "b.txt", "c.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+
+	original := []string{
+		filepath.Join(tmpDir, "a.txt"),
+		filepath.Join(tmpDir, "b.txt"),
+		filepath.Join(tmpDir, "c.txt"),
+	}
+	writeContents(t, original)
+
+	logPath, err := rename.CreateLog()
+	if err != nil {
+		t.Fatalf("Create log failed: %v", err)
+	}
+
+	// Round 1 swaps a and b, round 2 renames the result again
+	rounds := [][]string{
+		{filepath.Join(tmpDir, "b.txt"), filepath.Join(tmpDir, "a.txt"), filepath.Join(tmpDir, "d.txt")},
+		{filepath.Join(tmpDir, "x.txt"), filepath.Join(tmpDir, "a.txt"), filepath.Join(tmpDir, "b.txt")},
+	}
+	current := original
+	for i, edited := range rounds {
+		plan, err := rename.BuildRenamePlan(current, edited)
+		if err != nil {
+			t.Fatalf("Round %d: build plan failed: %v", i+1, err)
+		}
+		if err := rename.ExecuteRenames(plan, false); err != nil {
+			t.Fatalf("Round %d: execute failed: %v", i+1, err)
+		}
+		if err := rename.AppendLog(logPath, "Round", plan); err != nil {
+			t.Fatalf("Round %d: append log failed: %v", i+1, err)
+		}
+		current = edited
+	}
+
+	latest, err := rename.FindLatestLog()
+	if err != nil {
+		t.Fatalf("Find latest log failed: %v", err)
+	}
+	if latest != logPath {
+		t.Errorf("Expected latest log %s, got %s", logPath, latest)
+	}
+
+	plan, err := rename.ReadLog(logPath)
+	if err != nil {
+		t.Fatalf("Read log failed: %v", err)
+	}
+
+	undo := rename.UndoPlan(plan)
+	if err := rename.VerifyPlan(undo); err != nil {
+		t.Fatalf("Undo plan rejected: %v", err)
+	}
+	if err := rename.ExecuteRenames(undo, false); err != nil {
+		t.Fatalf("Execute undo failed: %v", err)
+	}
+
+	// A single undo reverts both rounds
+	for _, file := range original {
+		checkContent(t, file, filepath.Base(file))
+	}
+	for _, file := range []string{"d.txt", "x.txt"} {
+		if fileExists(filepath.Join(tmpDir, file)) {
+			t.Errorf("%s still exists after undo", file)
+		}
+	}
+}
+
+func TestVerifyPlanRejectsStaleUndo(t *testing.T) {
+	files := []string{"a.txt", "b.txt"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+
+	// b.txt was recreated after a.txt was renamed to it: undoing would clobber it
+	plan := []rename.RenameOp{
+		{From: filepath.Join(tmpDir, "b.txt"), To: filepath.Join(tmpDir, "a.txt")},
+	}
+	if err := rename.VerifyPlan(plan); err == nil {
+		t.Error("Expected overwrite of a.txt to be rejected")
+	}
+
+	plan = []rename.RenameOp{
+		{From: filepath.Join(tmpDir, "missing.txt"), To: filepath.Join(tmpDir, "c.txt")},
+	}
+	if err := rename.VerifyPlan(plan); err == nil {
+		t.Error("Expected missing source to be rejected")
+	}
+}
+
+func TestUndoRollsBackCycle(t *testing.T) {
+	files := []string{"a", "b", "c"}
+	tmpDir, cleanup := setupTestFiles(t, files)
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+	original := []string{path("a"), path("b"), path("c")}
+	writeContents(t, original)
+
+	plan, err := rename.BuildRenamePlan(original, []string{path("b"), path("c"), path("a")})
+	if err != nil {
+		t.Fatalf("Build plan failed: %v", err)
+	}
+	if err := rename.ExecuteRenames(plan, false); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	logPath, err := rename.CreateLog()
+	if err == nil {
+		err = rename.AppendLog(logPath, "", plan)
+	}
+	if err != nil {
+		t.Fatalf("Write log failed: %v", err)
+	}
+
+	// The cycle is read back as one group, and its undo stays one
+	logged, err := rename.ReadLog(logPath)
+	if err != nil {
+		t.Fatalf("Read log failed: %v", err)
+	}
+	undo := rename.UndoPlan(logged)
+	for _, op := range undo {
+		if op.Group == 0 || op.Group != undo[0].Group {
+			t.Fatalf("Expected the undo of a cycle to be one group, got %v", undo)
+		}
+	}
+
+	// The file now at c vanishes, so the undo fails part way through the
+	// cycle, and the step already done is rolled back
+	if err := os.Remove(path("c")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := rename.Execute(undo, rename.ExecOptions{}); err == nil {
+		t.Fatal("Expected the undo to fail")
+	}
+	checkContent(t, path("a"), "c")
+	checkContent(t, path("b"), "a")
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), rename.TempPrefix) {
+			t.Errorf("Temp file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestLogRoundTripHostileNames(t *testing.T) {
+	tmpDir, cleanup := setupTestFiles(t, nil)
+	defer cleanup()
+	t.Setenv("TMPDIR", tmpDir)
+
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+	attrs := rename.Attrs{Mode: 0644, User: "0", Group: "0", Mtime: time.Unix(1700000000, 5).UTC()}
+	plan := []rename.RenameOp{
+		// Names that read as a stash or backup entry, an exchange, a separator
+		// or a comment
+		{From: path("stash: a"), To: path("b")},
+		{From: path("c"), To: path("stash: d -> e")},
+		{From: path("f"), To: path("g"), Kind: rename.OpStash},
+		{From: path("h -> i"), To: path("j"), Kind: rename.OpStash},
+		{From: path("backup: a"), To: path("b~")},
+		{From: path("a -> b"), To: path("a -> b~"), Kind: rename.OpBackup},
+		{From: path("c"), To: path("backup: c~"), Kind: rename.OpBackup},
+		{From: path("a <-> b"), To: path("c")},
+		{From: path("d"), To: path("e <-> f")},
+		{From: path("g <-> h"), To: path("i -> j"), Kind: rename.OpExchange},
+		{From: path("k"), To: path("l"), Kind: rename.OpExchange},
+		{From: path("#k"), To: path("l")},
+		{From: `"m"`, To: path(" n ")},
+		{From: path("o\np"), To: path("q\x00")},
+		{From: path("r: s"), To: path("r: s"), Kind: rename.OpRelink, OldTarget: "t -> u", Target: "v: w"},
+		{From: path("x: y"), To: path("x: y"), Kind: rename.OpAttrs, OldAttrs: attrs, Attrs: attrs},
+	}
+
+	logPath, err := rename.WriteLog(plan)
+	if err != nil {
+		t.Fatalf("Write log failed: %v", err)
+	}
+	logged, err := rename.ReadLog(logPath)
+	if err != nil {
+		t.Fatalf("Read log failed: %v", err)
+	}
+	if len(logged) != len(plan) {
+		t.Fatalf("Expected %d entries, got %d: %v", len(plan), len(logged), logged)
+	}
+	// Relative paths are read back against the working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd failed: %v", err)
+	}
+	for i, op := range plan {
+		got := logged[i]
+		if !filepath.IsAbs(op.From) {
+			op.From = filepath.Join(cwd, op.From)
+		}
+		if got.From != op.From || got.To != op.To || got.Kind != op.Kind || got.OldTarget != op.OldTarget ||
+			got.Target != op.Target || !got.Attrs.Mtime.Equal(op.Attrs.Mtime) {
+			t.Errorf("Entry %d read back as %q, expected %q", i+1, got, op)
+		}
+	}
+}
@@ -13,13 +13,30 @@ gmv \- batch rename files using $EDITOR
 .B gmv
 [\fIOPTIONS\fR]
 .I files...
+.br
+.B gmv
+[\fIOPTIONS\fR]
+.B \-\-resume
+.br
+.B gmv undo
+[\fB\-\-dry\-run\fR]
+[\fIlogfile\fR]
+.br
+.B gmv doctor
+[\fB\-\-dry\-run\fR]
+[\fIdirs...\fR]
 .SH DESCRIPTION
 .B gmv
 is a command-line tool for batch renaming files using your preferred text editor.
 It opens a list of files in your $EDITOR, allowing you to edit the filenames.
+Directories are listed with a trailing slash and symlinks with a trailing
+.BR @ ,
+which is removed again when the buffer is read. Symlinks are renamed
+themselves, never the files they point to, and may be dangling.
 Upon saving and exiting, the files are renamed accordingly.
 .PP
-File swaps are automatically handled using temporary files to avoid conflicts.
+File swaps are exchanged atomically where supported, and cycles are handled
+using temporary files to avoid conflicts.
 A log of all rename operations is saved in the system's temporary directory.
 .PP
 The program includes safety checks for file overwrites. If renaming would overwrite
@@ -38,8 +55,162 @@ Also displays warnings for potential overwrites.
 Skip confirmation prompt when files would be overwritten.
 Use with caution as this can lead to data loss.
 .TP
+.B \-\-keep\-going, \-k
+Do not stop at the first rename that fails. Renames that depend on a
+failed one, such as the next link of a chain or the rest of a cycle, are
+skipped, and the completed steps of a failed cycle, backup or stash are
+rolled back. The rest of the plan still runs. Afterwards a summary lists
+the failures by cause and the skipped and rolled back renames. The log
+records the renames that succeeded and, as comments, the others.
+.TP
+.B \-\-check\-busy
+Before renaming, look in
+.I /proc
+for processes that hold a renamed file open, or that have it, or for a
+directory anything inside it, as their working directory, and warn with
+their PID and command name. Linux only.
+.TP
+.B \-\-skip\-busy
+Like
+.BR \-\-check\-busy ,
+but leave the files in use unrenamed, together with any rename that
+depends on them.
+.TP
+.B \-\-fix\-links \fIDIR
+Look under
+.I DIR
+for symlinks that point at a renamed file, or at anything inside a renamed
+directory, and point them at the new name, keeping relative links relative
+and absolute links absolute. Each link is replaced atomically by a new link
+renamed over it, and only if it still has the target it had when the plan
+was made. A link is updated just before the renames it depends on and is
+rolled back with them if one of them fails, so it never points at a name
+that does not exist. The relinks are listed in the log as
+.I "relink: link: old \-> new"
+and reverted by
+.BR "gmv undo" .
+.TP
+.B \-\-edit\-links
+Edit the targets of symlinks. Every file must be a symlink, and each line
+of the buffer reads
+.IR "link \-> target" .
+Changing the target retargets the link, atomically as with
+.BR \-\-fix\-links ;
+changing the name renames it. A link name cannot contain
+.IR " \-> " ,
+but a target can.
+.TP
+.B \-\-attrs
+Edit the mode, owner and modification time of each file. Each line of the
+buffer reads
+.IR "mode user:group time name" ,
+for example
+.IR "0644 alice:staff 2026-01-02T10:00 notes.txt" ,
+with the time in local time. Only the changed fields are applied, with
+chown, chmod and chtimes, and only if each still has its old value. The
+changes are listed in the log as
+.I "attrs: file: old \-> new"
+with the full modification time, and reverted by
+.BR "gmv undo" .
+Symlinks only have an owner to change.
+.TP
+.B \-\-backup\fR[=\fIPOLICY\fR], \fB\-b
+Before overwriting a file, move it to a backup name.
+.I simple
+keeps it as
+.IR name~ ,
+.I numbered
+as
+.IR name.~N~ ,
+and
+.IR existing ,
+the default, uses numbered backups for files that already have
+numbered backups and simple ones otherwise. The GNU names
+.IR never ,
+.I t
+and
+.I nil
+are accepted too. A backup never replaces an existing file; if the
+backup name is taken, nothing is renamed. Backups are recorded in the
+log and restored by
+.BR "gmv undo" .
+.TP
+.B \-\-tui
+Edit the names in the built-in full-screen editor instead of $EDITOR.
+The built-in editor previews conflicts as you type and supports
+find (Ctrl-F), replace (Ctrl-R), multi-select (Tab, Ctrl-A) and
+reverting lines (Ctrl-O). Press Ctrl-S to apply or Ctrl-Q to quit.
+.TP
+.B \-\-review
+After editing, show each rename as a diff with the changed words
+highlighted, and choose which renames to apply. Space toggles a rename,
+.B a
+and
+.B n
+accept or reject all,
+.B e
+re-opens the editor, Enter applies the accepted renames and
+.B q
+quits. Rejecting a rename that an accepted rename depends on is reported
+as a conflict.
+.TP
+.B \-\-interactive, \-i
+Confirm each rename individually. Answer
+.B y
+to apply the rename,
+.B n
+to skip it,
+.B a
+to apply it and all remaining renames, or
+.B q
+to skip it and all remaining renames. Renames that depend on a skipped
+rename, such as the rest of a cycle or the previous link of a chain,
+are skipped as well.
+.TP
+.B \-\-loop
+After each successful apply, re-open the editor on the new names.
+Stop when the buffer is saved unchanged. All rounds are recorded in
+one log, so a single
+.B gmv undo
+reverts the whole session. Cannot be combined with
+.BR \-\-dry\-run .
+.TP
+.B \-\-resume
+Re-open the last unfinished session, with its edits intact. A session
+is unfinished when validation failed, the operation was cancelled or
+gmv was interrupted. gmv changes to the session's working directory
+before continuing.
+.TP
 .B \-\-help, \-h
 Display help information and exit.
+.SH COMMANDS
+.TP
+.B undo \fR[\fIlogfile\fR]
+Revert every rename recorded in
+.IR logfile ,
+or in the most recent log if none is given. The renames are checked
+against the files on disk first, and nothing is changed if a renamed
+file has since been moved or a reverted name is taken. Files are matched
+by name only, so one replaced by another of the same name is reverted like
+the original. With
+.BR \-\-dry\-run ,
+the reverse renames are only printed. Undo writes its own log, so
+running it twice redoes the renames. The log keeps the steps of a cycle
+or of a backup or stash hop together, so undo reverts each one whole or
+not at all. If undo stops part way, its log records what was reverted.
+.TP
+.B doctor \fR[\fIdirs...\fR]
+Find
+.I .gmv_temp_*
+files left behind by an interrupted run, in
+.I dirs
+(default: the current directory) and in every directory named by an
+unfinished journal. Each temp file name encodes the session that created
+it; the session's journal, or failing that its log, tells where the file
+belongs. It is renamed to its intended name, or back to its original
+name if the intended one is still taken. With
+.BR \-\-dry\-run ,
+the restores are only printed.
 .SH EXAMPLES
 .TP
 .B gmv test-file.go
@@ -65,6 +236,22 @@ Preview rename operations without applying them.
 .TP
 .B gmv \-\-force *
 Skip overwrite confirmation prompts.
+.TP
+.B gmv \-b *
+Keep a backup of every file that would be overwritten.
+.TP
+.B gmv \-\-edit\-links data/*
+Retarget the symlinks in data.
+.TP
+.B gmv \-\-attrs *.sh
+Change the permissions, owners or modification times of the scripts.
+.TP
+.B gmv \-\-fix\-links . lib/*
+Rename libraries and update the symlinks in the current tree that point
+at them.
+.TP
+.B gmv undo
+Revert the most recent rename session.
 .SH ENVIRONMENT
 .TP
 .B EDITOR
@@ -73,13 +260,55 @@ If not set, defaults to
 .B vi
 or
 .B nano
-(whichever is available).
+(whichever is available). If none of these exist,
+the built-in editor is used.
+.TP
+.B XDG_STATE_HOME
+Base directory for session state. Defaults to
+.IR ~/.local/state .
+.TP
+.B GMV_STASH_DAYS
+Number of days stashed files are kept before they are pruned.
+Defaults to 30. Set to 0 to replace overwritten files without
+stashing them.
 .SH FILES
 .TP
+.I $XDG_STATE_HOME/gmv/journal/
+The plan of each run, written before the first rename and removed once
+the run finishes. Used by
+.BR "gmv doctor" .
+.TP
+.I $XDG_STATE_HOME/gmv/stash/
+Files replaced by confirmed overwrites, one directory per run. When
+the state directory is on a different filesystem from a replaced
+file, the file is stashed in a hidden
+.I .gmv_stash_<session>
+directory next to it instead. Pruned after
+.B GMV_STASH_DAYS
+days.
+.TP
+.I $XDG_STATE_HOME/gmv/sessions/
+Editor buffers of unfinished sessions, used by
+.BR \-\-resume .
+Removed when the renames succeed, and pruned after a week otherwise.
+.TP
+.I /tmp/gmv-locks/
+Who holds the lock on each directory in use: user, PID and start time.
+.TP
 .I /tmp/gmv-log-YYYYMMDD-HHMMSS
 Log files containing records of rename operations.
 Each log file includes a timestamp and the working directory
-where the operations were performed.
+where the operations were performed. A path that could be misread as
+part of an entry, such as one containing
+.I " \-> "
+or
+.IR " <\-> " ,
+or starting with
+.I "stash: "
+or
+.IR "backup: " ,
+or one with unprintable characters, is written as a double-quoted Go
+string.
 .SH EXIT STATUS
 .TP
 .B 0
@@ -87,6 +316,16 @@ Success
 .TP
 .B 1
 Error occurred (invalid arguments, file not found, validation failed, etc.)
+.TP
+.B 2
+With
+.BR \-\-keep\-going ,
+some renames failed or were skipped; the others were applied
+.TP
+.B 130, 143
+Interrupted by SIGINT or SIGTERM. When renames were running, the cycle
+or backup in progress was completed, the rest were not run, and the
+log records what was done.
 .SH NOTES
 .PP
 .B gmv
@@ -99,10 +338,51 @@ Files cannot be moved to different directories
 Duplicate target filenames are not allowed (except in swap operations)
 .IP \(bu 2
 Empty lines or deleted lines will cause an error
+.IP \(bu 2
+A file cannot replace a directory, nor a directory a file
+.IP \(bu 2
+Names cannot be
+.B .
+or
+.BR .. ,
+contain a slash, a NUL byte or another control character, or be longer
+than the filesystem allows (NAME_MAX, usually 255 bytes)
+.PP
+Paths are compared after cleaning, so
+.I ./a
+and
+.IR a ,
+or
+.I dir/
+and
+.IR dir ,
+are the same file. In case-insensitive directories (vfat, exFAT, CIFS,
+macOS volumes, ext4 with casefold), names differing only in case are the
+same file too: such targets are duplicates, and a rename that only changes
+the case of a name goes through a temporary file.
+.PP
+The plan is then replayed on an in-memory model of the directory entries
+it touches. Unless every file ends up at its edited name, no file is
+replaced without a confirmed overwrite and no temporary file remains,
+nothing is renamed.
+.PP
+Before the first rename, including with
+.BR \-\-dry\-run ,
+every rename is checked for problems that would make it fail part way
+through: a parent directory that is not writable or is on a read-only
+filesystem, a file owned by another user in a sticky directory, an
+immutable or append-only file or directory, and a directory that is a
+mount point. All problems are listed together and nothing is renamed,
+unless
+.B \-\-keep\-going
+is given.
 .PP
 When files are swapped (e.g., file1 \(-> file2 and file2 \(-> file1),
 .B gmv
-automatically uses temporary files to handle the operation safely.
+exchanges them atomically with
+.BR renameat2 (2)
+and RENAME_EXCHANGE on Linux. Longer cycles, and swaps on systems or
+filesystems without RENAME_EXCHANGE, go through a temporary file.
 .PP
 .B Overwrite Protection
 .PP
@@ -113,6 +393,64 @@ for confirmation. File swaps and cycles within the rename list are allowed and
 will not trigger the overwrite warning. Use
 .B \-\-force
 to bypass the confirmation prompt.
+.PP
+Each confirmed overwrite first moves the replaced file into the stash,
+and the log records where it went, so
+.B gmv undo
+restores it. With
+.BR \-\-backup ,
+the file is kept under a backup name instead.
+.PP
+Renames that were not confirmed as overwrites use RENAME_NOREPLACE on
+Linux, so a file that appears at the target after the check is never
+clobbered; the rename fails instead. Where the flag is unsupported, the
+target is checked again immediately before renaming.
+.PP
+Before the first rename, every parent directory is opened without
+following symlinks and compared with the directory recorded at
+validation time. If any of them has been replaced, nothing is renamed.
+On Linux, renames are then performed with
+.BR renameat (2)
+relative to the open directories, which also makes trees deeper than
+PATH_MAX work.
+.PP
+Each file's device, inode, size and modification time are recorded when
+the editor opens and compared again just before renaming. If a file was
+replaced, removed or modified in the meantime, nothing is renamed. For
+directories only the device and inode are compared.
+.PP
+.B Progress
+.PP
+While renaming on a terminal,
+.B gmv
+draws a progress bar with the rate and estimated time left on standard
+error. Otherwise it prints one line per rename on standard output.
+.PP
+.B Signals
+.PP
+SIGINT and SIGTERM during renaming, including by
+.B gmv undo
+and
+.BR "gmv doctor" ,
+take effect only between cycles, so a cycle is never left with a file
+under its temporary name. While an
+external editor runs, SIGINT is ignored by
+.B gmv
+and handled by the editor.
+.PP
+.B Concurrent Sessions
+.PP
+From validation until the last rename,
+.B gmv
+holds an advisory
+.BR flock (2)
+lock on each directory it renames in, taken in a fixed order.
+.B gmv undo
+and
+.B gmv doctor
+lock the directories they touch as well. If another session holds a
+lock, gmv exits with an error naming that session's user, PID and start
+time.
 .SH BUGS
 Report bugs at: https://github.com/ishrq/gmv/issues
 .SH AUTHOR